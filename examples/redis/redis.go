@@ -17,8 +17,17 @@ func main() {
 	}))
 
 	// Create Redis storage with default config
-	cfg := storage.DefaultRedisConfig()
-	client := storage.NewRedisClient(cfg)
+	cfg, err := storage.DefaultRedisConfig()
+	if err != nil {
+		logger.Error("invalid redis config", "error", err)
+		os.Exit(1)
+	}
+	client, err := storage.NewRedisClient(cfg)
+	if err != nil {
+		logger.Error("failed to create redis client", "error", err)
+		os.Exit(1)
+	}
+	defer client.Close()
 	store := storage.NewRedisStorage(client)
 
 	// Create rate limiter with default options
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// AccessList matches requests by client IP network, client key or header
+// value, such as a partner token. It is safe for concurrent use and can be
+// updated while the middleware serves requests.
+type AccessList struct {
+	mu       sync.RWMutex
+	prefixes []netip.Prefix
+	keys     map[string]struct{}
+	headers  map[string]map[string]struct{} // values by canonical header name
+}
+
+// NewAccessList creates an empty access list
+func NewAccessList() *AccessList {
+	return &AccessList{
+		keys:    make(map[string]struct{}),
+		headers: make(map[string]map[string]struct{}),
+	}
+}
+
+// AddCIDR matches clients whose IP is in the given CIDR or equals the given address
+func (l *AccessList) AddCIDR(cidr string) error {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !slices.Contains(l.prefixes, prefix) {
+		l.prefixes = append(l.prefixes, prefix)
+	}
+	return nil
+}
+
+// RemoveCIDR stops matching a CIDR added with AddCIDR
+func (l *AccessList) RemoveCIDR(cidr string) error {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prefixes = slices.DeleteFunc(l.prefixes, func(p netip.Prefix) bool {
+		return p == prefix
+	})
+	return nil
+}
+
+// AddKey matches requests with the given client key, as returned by the middleware's key functions
+func (l *AccessList) AddKey(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.keys[key] = struct{}{}
+}
+
+// RemoveKey stops matching a key added with AddKey
+func (l *AccessList) RemoveKey(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.keys, key)
+}
+
+// AddHeader matches requests carrying the header with the given value
+func (l *AccessList) AddHeader(name, value string) {
+	name = http.CanonicalHeaderKey(name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.headers[name] == nil {
+		l.headers[name] = make(map[string]struct{})
+	}
+	l.headers[name][value] = struct{}{}
+}
+
+// RemoveHeader stops matching a header value added with AddHeader
+func (l *AccessList) RemoveHeader(name, value string) {
+	name = http.CanonicalHeaderKey(name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.headers[name], value)
+	if len(l.headers[name]) == 0 {
+		delete(l.headers, name)
+	}
+}
+
+// match reports whether the request matches the list, and what it matched
+// on: "cidr", "key" or "header"
+func (l *AccessList) match(r *http.Request, ip string, keys []string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range l.prefixes {
+			if prefix.Contains(addr) {
+				return "cidr", true
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if _, ok := l.keys[key]; ok {
+			return "key", true
+		}
+	}
+
+	for name, values := range l.headers {
+		for _, value := range r.Header.Values(name) {
+			if _, ok := values[value]; ok {
+				return "header", true
+			}
+		}
+	}
+
+	return "", false
+}
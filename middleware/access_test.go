@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	list := NewAccessList()
+	if err := list.AddCIDR("10.0.0.0/8"); err != nil {
+		t.Fatalf("Failed to add CIDR: %v", err)
+	}
+	if err := list.AddCIDR("2001:db8::1"); err != nil {
+		t.Fatalf("Failed to add address: %v", err)
+	}
+	list.AddKey("header:X-Api-Key:internal")
+	list.AddHeader("x-partner-token", "secret")
+
+	tests := []struct {
+		name  string
+		ip    string
+		keys  []string
+		token string
+		want  string
+	}{
+		{"cidr", "10.1.2.3", nil, "", "cidr"},
+		{"address", "2001:db8::1", nil, "", "cidr"},
+		{"key", "203.0.113.7", []string{"header:X-Api-Key:internal"}, "", "key"},
+		{"header", "203.0.113.7", nil, "secret", "header"},
+		{"no match", "203.0.113.7", []string{"203.0.113.7"}, "wrong", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.token != "" {
+			req.Header.Set("X-Partner-Token", tt.token)
+		}
+
+		match, ok := list.match(req, tt.ip, tt.keys)
+		if ok != (tt.want != "") || match != tt.want {
+			t.Errorf("%s: expected match %q, got %q", tt.name, tt.want, match)
+		}
+	}
+
+	// Removed entries stop matching
+	if err := list.RemoveCIDR("10.0.0.0/8"); err != nil {
+		t.Fatalf("Failed to remove CIDR: %v", err)
+	}
+	list.RemoveKey("header:X-Api-Key:internal")
+	list.RemoveHeader("X-Partner-Token", "secret")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Partner-Token", "secret")
+	if match, ok := list.match(req, "10.1.2.3", []string{"header:X-Api-Key:internal"}); ok {
+		t.Errorf("Expected no match after removal, got %q", match)
+	}
+
+	if err := list.AddCIDR("not-a-cidr"); err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+}
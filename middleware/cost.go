@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CostFunc returns how many requests an HTTP request counts as. Costs below
+// 1 count as 1, so a CostFunc can't give requests away for free.
+type CostFunc func(r *http.Request) int
+
+// CostByMethod returns a CostFunc that looks up the cost by request method,
+// falling back to defaultCost for methods not in costs
+func CostByMethod(costs map[string]int, defaultCost int) CostFunc {
+	return func(r *http.Request) int {
+		if cost, ok := costs[r.Method]; ok {
+			return cost
+		}
+		return defaultCost
+	}
+}
+
+// CostByRoute returns a CostFunc that looks up the cost by request path,
+// falling back to defaultCost for unmatched paths. Routes follow http.ServeMux
+// path rules: a route ending in a slash matches every path under it, and the
+// longest matching route wins. Paths are matched in their canonical form, like
+// a PolicyRouter does.
+func CostByRoute(costs map[string]int, defaultCost int) CostFunc {
+	return func(r *http.Request) int {
+		path := cleanPath(r.URL.Path)
+		if cost, ok := costs[path]; ok {
+			return cost
+		}
+
+		cost, matched := defaultCost, ""
+		for route, c := range costs {
+			if strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) && len(route) > len(matched) {
+				cost, matched = c, route
+			}
+		}
+		return cost
+	}
+}
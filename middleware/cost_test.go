@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCostByMethod(t *testing.T) {
+	cost := CostByMethod(map[string]int{"POST": 5}, 1)
+
+	if got := cost(httptest.NewRequest("POST", "/", nil)); got != 5 {
+		t.Errorf("Expected cost 5 for POST, got %d", got)
+	}
+	if got := cost(httptest.NewRequest("GET", "/", nil)); got != 1 {
+		t.Errorf("Expected default cost 1 for GET, got %d", got)
+	}
+}
+
+func TestCostByRoute(t *testing.T) {
+	cost := CostByRoute(map[string]int{
+		"/api/":        2,
+		"/api/search":  10,
+		"/api/export/": 50,
+	}, 1)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/search", 10},
+		{"/api/export/users", 50},
+		{"/api/users", 2},
+		{"/health", 1},
+		{"//api/search", 10},
+		{"/api/./export/../search", 10},
+		{"/health/../api/export/users", 50},
+	}
+
+	for _, tt := range tests {
+		if got := cost(httptest.NewRequest("GET", tt.path, nil)); got != tt.want {
+			t.Errorf("Expected cost %d for %s, got %d", tt.want, tt.path, got)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+// FailurePolicy decides what happens to a request when the rate limiter's
+// storage fails, e.g. because Redis is unreachable
+type FailurePolicy int
+
+const (
+	// FailError responds with 500 Internal Server Error
+	FailError FailurePolicy = iota
+	// FailOpen lets the request through unlimited
+	FailOpen
+	// FailClosed responds with 503 Service Unavailable
+	FailClosed
+	// FailClosedTooManyRequests rejects the request as if it were over the limit
+	FailClosedTooManyRequests
+)
+
+// failureDecision returns the decision a failure policy takes
+func failureDecision(policy FailurePolicy) Decision {
+	switch policy {
+	case FailOpen:
+		return DecisionFailedOpen
+	case FailClosed, FailClosedTooManyRequests:
+		return DecisionFailedClosed
+	default:
+		return DecisionError
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+// defaultPolicy names the quota policy in RateLimit headers when the limiter has no rules
+const defaultPolicy = "default"
+
+// setRateLimitHeaders reports the client's quota with the RateLimit and
+// RateLimit-Policy headers of the IETF httpapi-ratelimit-headers draft, and
+// the legacy X-RateLimit-* headers when enabled. The policy is named after
+// the limiter's most restrictive rule, or else the route's policy.
+func (m *RateLimitMiddleware) setRateLimitHeaders(w http.ResponseWriter, resp ratelimiter.Response, policy string) {
+	name := resp.Rule
+	if name == "" {
+		name = policy
+	}
+	if name == "" {
+		name = defaultPolicy
+	}
+	name = quoteString(name)
+
+	quota := fmt.Sprintf("%s;q=%d", name, resp.Limit)
+	if window := ceilSeconds(resp.Window); window > 0 {
+		quota += fmt.Sprintf(";w=%d", window)
+	}
+
+	limit := fmt.Sprintf("%s;r=%d", name, resp.RequestsLeft)
+	if !resp.ResetAt.IsZero() {
+		limit += fmt.Sprintf(";t=%d", max(ceilSeconds(time.Until(resp.ResetAt)), 0))
+	}
+
+	w.Header().Set("RateLimit-Policy", quota)
+	w.Header().Set("RateLimit", limit)
+
+	if !m.legacyHeaders {
+		return
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(resp.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(resp.RequestsLeft))
+	if !resp.ResetAt.IsZero() {
+		// Unix time in seconds, as popularized by GitHub's API
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(resp.ResetAt.UnixMilli())/1000)), 10))
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// quoteString encodes s as a structured field string (RFC 8941)
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
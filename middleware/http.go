@@ -1,10 +1,10 @@
 package middleware
 
 import (
-	"encoding/json"
+	"errors"
 	"log/slog"
-	"net"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
@@ -23,60 +23,236 @@ type ErrorResponse struct {
 type RateLimitMiddleware struct {
 	limiter *ratelimiter.RateLimiter
 	logger  *slog.Logger
+	cost    CostFunc
+	keys    []KeyFunc
+	ips     *IPResolver
+	prefix  IPPrefix
+
+	legacyHeaders bool
+	onLimited     LimitedHandler
+
+	failurePolicy FailurePolicy
+	fallback      *ratelimiter.RateLimiter
+	metrics       Metrics
+
+	policies *PolicyRouter
+
+	allowList *AccessList
+	denyList  *AccessList
+}
+
+// Option is a function that configures a RateLimitMiddleware
+type Option func(*RateLimitMiddleware)
+
+// WithCostFunc sets the function deriving the cost of each request
+func WithCostFunc(fn CostFunc) Option {
+	return func(m *RateLimitMiddleware) {
+		m.cost = fn
+	}
+}
+
+// WithKeyFunc sets the function extracting the rate limit key from each request.
+// Requests without a key are limited by client IP.
+func WithKeyFunc(fn KeyFunc) Option {
+	return func(m *RateLimitMiddleware) {
+		m.keys = []KeyFunc{fn}
+	}
+}
+
+// WithKeyFuncs limits each request by several keys at once, e.g. the client's
+// IPv6 /64 and /48 networks. A request is only allowed if every key is within
+// its limit. Absent keys are skipped, and requests without any key are limited
+// by client IP.
+func WithKeyFuncs(fns ...KeyFunc) Option {
+	return func(m *RateLimitMiddleware) {
+		m.keys = fns
+	}
+}
+
+// WithIPPrefix limits clients by the network their IP belongs to rather than
+// by the single address
+func WithIPPrefix(p IPPrefix) Option {
+	return func(m *RateLimitMiddleware) {
+		m.prefix = p
+	}
+}
+
+// WithIPResolver sets how client IPs are resolved behind trusted proxies. By
+// default only the connection's remote address is used.
+func WithIPResolver(res *IPResolver) Option {
+	return func(m *RateLimitMiddleware) {
+		m.ips = res
+	}
+}
+
+// WithLegacyHeaders also reports the quota with the X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset headers still expected by
+// many clients
+func WithLegacyHeaders() Option {
+	return func(m *RateLimitMiddleware) {
+		m.legacyHeaders = true
+	}
+}
+
+// WithOnLimited sets the handler writing the response to requests over the
+// limit, such as RespondProblem or RespondNegotiated. By default the
+// ErrorResponse JSON body is written.
+func WithOnLimited(fn LimitedHandler) Option {
+	return func(m *RateLimitMiddleware) {
+		m.onLimited = fn
+	}
+}
+
+// WithFailurePolicy sets what happens to requests when the limiter's storage
+// fails. By default they are rejected with 500 Internal Server Error.
+func WithFailurePolicy(policy FailurePolicy) Option {
+	return func(m *RateLimitMiddleware) {
+		m.failurePolicy = policy
+	}
+}
+
+// WithFallbackLimiter checks requests against another limiter when the
+// storage fails, typically one backed by a MemoryStorage with reduced limits.
+// The failure policy applies only if the fallback fails too.
+func WithFallbackLimiter(limiter *ratelimiter.RateLimiter) Option {
+	return func(m *RateLimitMiddleware) {
+		m.fallback = limiter
+	}
+}
+
+// WithMetrics reports the decision taken for every request
+func WithMetrics(metrics Metrics) Option {
+	return func(m *RateLimitMiddleware) {
+		m.metrics = metrics
+	}
+}
+
+// WithPolicyRouter limits requests matching a policy with its limiter, keyed
+// by the policy name and client key. Other requests use the middleware's
+// limiter.
+func WithPolicyRouter(router *PolicyRouter) Option {
+	return func(m *RateLimitMiddleware) {
+		m.policies = router
+	}
+}
+
+// WithAllowList lets requests matching the list through without limiting
+// them, e.g. health checkers and internal services
+func WithAllowList(list *AccessList) Option {
+	return func(m *RateLimitMiddleware) {
+		m.allowList = list
+	}
+}
+
+// WithDenyList rejects requests matching the list with 403 Forbidden before
+// they are limited. It takes precedence over the allow list.
+func WithDenyList(list *AccessList) Option {
+	return func(m *RateLimitMiddleware) {
+		m.denyList = list
+	}
 }
 
 // NewRateLimitMiddleware creates a new rate limit middleware
-func NewRateLimitMiddleware(limiter *ratelimiter.RateLimiter, logger *slog.Logger) *RateLimitMiddleware {
-	return &RateLimitMiddleware{
+func NewRateLimitMiddleware(limiter *ratelimiter.RateLimiter, logger *slog.Logger, opts ...Option) *RateLimitMiddleware {
+	m := &RateLimitMiddleware{
 		limiter: limiter,
 		logger:  logger,
+		cost:    func(*http.Request) int { return 1 },
+		ips:     &IPResolver{},
+
+		onLimited: RespondJSON,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if len(m.keys) == 0 {
+		m.keys = []KeyFunc{KeyFromIPPrefix(m.ips, m.prefix)}
 	}
+
+	return m
 }
 
 // Handler wraps an HTTP handler with rate limiting
 func (m *RateLimitMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract client IP
-		ip := getClientIP(r)
+		// Extract the client keys, falling back to its IP
+		keys := m.clientKeys(r)
 
-		// Check rate limit
-		resp, err := m.limiter.Allow(ip)
-		if err != nil {
-			m.logger.Error("rate limit check failed", 
-				"error", err,
-				"ip", ip,
-			)
+		// Screen known clients before counting their requests
+		if decision, ok := m.screen(r, keys); ok {
+			if m.metrics != nil {
+				m.metrics.ObserveDecision(r, decision)
+			}
+			if decision == DecisionDenied {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Pick the limiter of the request's route, namespacing its keys
+		limiter, policy := m.limiter, ""
+		if m.policies != nil {
+			if p, ok := m.policies.Match(r); ok {
+				limiter, policy = p.Limiter, p.Name
+				for i, key := range keys {
+					keys[i] = policy + ":" + key
+				}
+			}
+		}
+
+		// Check rate limit for the request's cost, falling back when the storage fails
+		cost := max(m.cost(r), 1)
+		key, resp, decision := m.decide(r, limiter, keys, cost)
+		if m.metrics != nil {
+			m.metrics.ObserveDecision(r, decision)
+		}
+
+		switch decision {
+		case DecisionError:
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
+		case DecisionFailedOpen:
+			next.ServeHTTP(w, r)
+			return
+		case DecisionFailedClosed:
+			w.Header().Set("Retry-After", "1")
+			if m.failurePolicy == FailClosedTooManyRequests {
+				m.onLimited(w, r, ratelimiter.Response{RetryAfter: time.Now().Add(time.Second)})
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Requests costing more than the limit have no quota to report and can't be retried
+		if resp.Limit > 0 {
+			m.setRateLimitHeaders(w, resp, policy)
 		}
 
 		if !resp.Allowed {
-			// Calculate retry after in seconds
-			retryAfterSecs := int(time.Until(resp.RetryAfter).Seconds())
-			
-			// Set headers
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSecs))
-			w.WriteHeader(http.StatusTooManyRequests)
-
-			// Create error response
-			errResp := ErrorResponse{
-				Error:        "Rate limit exceeded",
-				Limit:        resp.Limit,
-				RequestsMade: resp.RequestsMade,
-				RetryAfter:   resp.RetryAfter,
+			if !resp.RetryAfter.IsZero() {
+				retryAfterSecs := max(ceilSeconds(time.Until(resp.RetryAfter)), 0)
+				w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSecs, 10))
 			}
 
 			// Log rate limit exceeded
 			m.logger.Info("rate limit exceeded",
-				"ip", ip,
+				"key", key,
+				"cost", cost,
 				"requests_made", resp.RequestsMade,
 				"limit", resp.Limit,
 				"retry_after", resp.RetryAfter,
+				"offenses", resp.Offenses,
+				"decision", decision,
+				"policy", policy,
 			)
 
-			// Send JSON response
-			json.NewEncoder(w).Encode(errResp)
+			// Send the rejection
+			m.onLimited(w, r, resp)
 			return
 		}
 
@@ -85,17 +261,132 @@ func (m *RateLimitMiddleware) Handler(next http.Handler) http.Handler {
 	})
 }
 
-// getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := net.ParseIP(xff)
-		if ips != nil {
-			return ips.String()
+// screen checks the request against the deny list, then the allow list
+func (m *RateLimitMiddleware) screen(r *http.Request, keys []string) (Decision, bool) {
+	if m.denyList == nil && m.allowList == nil {
+		return "", false
+	}
+	ip := m.ips.ClientIP(r)
+
+	if m.denyList != nil {
+		if match, ok := m.denyList.match(r, ip, keys); ok {
+			m.logger.Info("request denied",
+				"ip", ip,
+				"keys", keys,
+				"match", match,
+				"decision", DecisionDenied,
+			)
+			return DecisionDenied, true
+		}
+	}
+
+	if m.allowList != nil {
+		if match, ok := m.allowList.match(r, ip, keys); ok {
+			m.logger.Debug("rate limit bypassed",
+				"ip", ip,
+				"keys", keys,
+				"match", match,
+				"decision", DecisionBypassed,
+			)
+			return DecisionBypassed, true
+		}
+	}
+
+	return "", false
+}
+
+// decide checks the request against the limiter, then the fallback limiter
+// and finally the failure policy while the storages fail
+func (m *RateLimitMiddleware) decide(r *http.Request, limiter *ratelimiter.RateLimiter, keys []string, cost int) (string, ratelimiter.Response, Decision) {
+	key, resp, err := m.check(r, limiter, keys, cost)
+	if err == nil {
+		if resp.Allowed {
+			return key, resp, DecisionAllowed
+		}
+		return key, resp, DecisionLimited
+	}
+
+	// Requests costing more than the limit are never allowed, whatever the storage
+	if errors.Is(err, ratelimiter.ErrExceedsLimit) {
+		return key, resp, DecisionLimited
+	}
+
+	if m.fallback != nil {
+		m.logger.Warn("rate limit check failed, using fallback limiter",
+			"error", err,
+			"key", key,
+		)
+
+		key, resp, err = m.check(r, m.fallback, keys, cost)
+		if err == nil {
+			if resp.Allowed {
+				return key, resp, DecisionFallbackAllowed
+			}
+			return key, resp, DecisionFallbackLimited
+		}
+	}
+
+	decision := failureDecision(m.failurePolicy)
+	m.logger.Error("rate limit check failed",
+		"error", err,
+		"key", key,
+		"decision", decision,
+	)
+	return key, resp, decision
+}
+
+// check counts the request against every key, giving back what earlier keys
+// took if a later one denies the request or fails. It returns the key that
+// denied the request, or the one with the fewest requests left.
+func (m *RateLimitMiddleware) check(r *http.Request, limiter *ratelimiter.RateLimiter, keys []string, cost int) (string, ratelimiter.Response, error) {
+	var (
+		key          string
+		resp         ratelimiter.Response
+		reservations []*ratelimiter.Reservation
+	)
+	for _, k := range keys {
+		res, err := limiter.ReserveNContext(r.Context(), k, cost)
+		if err != nil {
+			m.cancel(r, reservations)
+			return k, ratelimiter.Response{}, err
+		}
+
+		if !res.OK() {
+			m.cancel(r, reservations)
+			return k, res.Response(), nil
+		}
+		if len(reservations) == 0 || res.Response().RequestsLeft < resp.RequestsLeft {
+			key, resp = k, res.Response()
+		}
+		reservations = append(reservations, res)
+	}
+	return key, resp, nil
+}
+
+// clientKeys returns the distinct rate limit keys of a request
+func (m *RateLimitMiddleware) clientKeys(r *http.Request) []string {
+	keys := make([]string, 0, len(m.keys))
+	for _, fn := range m.keys {
+		key, ok := fn(r)
+		if ok && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		key, _ := KeyFromIPPrefix(m.ips, m.prefix)(r)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// cancel gives back the capacity taken by reservations of a denied request
+func (m *RateLimitMiddleware) cancel(r *http.Request, reservations []*ratelimiter.Reservation) {
+	for _, res := range reservations {
+		if err := res.CancelContext(r.Context()); err != nil {
+			m.logger.Warn("failed to cancel reservation",
+				"error", err,
+			)
 		}
 	}
-	
-	// Extract from RemoteAddr
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
 }
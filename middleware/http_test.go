@@ -1,13 +1,16 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/devfullcycle/ratelimiter/ratelimiter"
+	"github.com/devfullcycle/ratelimiter/storage"
 	"log/slog"
 	"os"
 )
@@ -52,32 +55,436 @@ func TestRateLimitMiddleware(t *testing.T) {
 	}
 }
 
+func TestRateLimitMiddlewareCost(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	storage := &mockStorage{}
+	limiter := ratelimiter.New(storage)
+	middleware := NewRateLimitMiddleware(limiter, logger, WithCostFunc(func(r *http.Request) int {
+		return 10
+	}))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rec.Code)
+	}
+	if storage.count != 10 {
+		t.Errorf("Expected request to count as 10, got %d", storage.count)
+	}
+}
+
+func TestRateLimitMiddlewareInvalidCost(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Costs below one count as a single request
+	storage := &mockStorage{}
+	middleware := NewRateLimitMiddleware(ratelimiter.New(storage), logger, WithCostFunc(func(r *http.Request) int {
+		return -5
+	}))
+	rec := httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || storage.count != 1 {
+		t.Errorf("Expected request to count as 1, got status %d and count %d", rec.Code, storage.count)
+	}
+
+	// Costs over the limit are denied without quota headers or a Retry-After
+	middleware = NewRateLimitMiddleware(ratelimiter.New(&mockStorage{}, ratelimiter.WithMaxRequests(10)), logger, WithCostFunc(func(r *http.Request) int {
+		return 11
+	}))
+	rec = httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Expected no Retry-After header, got %q", got)
+	}
+	if got := rec.Header().Get("RateLimit"); got != "" {
+		t.Errorf("Expected no RateLimit header, got %q", got)
+	}
+}
+
+func TestRateLimitMiddlewareKeyFunc(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	storage := &mockStorage{}
+	limiter := ratelimiter.New(storage)
+	middleware := NewRateLimitMiddleware(limiter, logger, WithKeyFunc(KeyFromHeader("X-API-Key")))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-API-Key", "secret")
+	rec := httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, req)
+
+	if storage.key != "header:X-Api-Key:secret" {
+		t.Errorf("Expected request to be limited by API key, got key %q", storage.key)
+	}
+
+	// Requests without the header fall back to the client IP
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, req)
+
+	if storage.key != "10.0.0.1" {
+		t.Errorf("Expected request to be limited by IP, got key %q", storage.key)
+	}
+}
+
+func TestRateLimitMiddlewareKeyFuncs(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	store := storage.NewMemoryStorage()
+	limiter := ratelimiter.New(store, ratelimiter.WithMaxRequests(2))
+	res := &IPResolver{}
+	middleware := NewRateLimitMiddleware(limiter, logger, WithKeyFuncs(
+		KeyFromIPPrefix(res, IPPrefix{IPv6: 64}),
+		KeyFromIPPrefix(res, IPPrefix{IPv6: 48}),
+	))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Rotating through /64s within the same /48 only gets so far
+	for i, remote := range []string{"[2001:db8:1:1::1]:1234", "[2001:db8:1:2::1]:1234", "[2001:db8:1:3::1]:1234"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		middleware.Handler(handler).ServeHTTP(rec, req)
+
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if rec.Code != want {
+			t.Errorf("Request %d: expected status code %d, got %d", i+1, want, rec.Code)
+		}
+	}
+
+	// The denied request doesn't count against its /64
+	count, err := store.GetRequests(context.Background(), "2001:db8:1:3::/64")
+	if err != nil {
+		t.Fatalf("Failed to get requests: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected denied request to be refunded, got count %d", count)
+	}
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	limiter := ratelimiter.New(storage.NewMemoryStorage(), ratelimiter.WithMaxRequests(2))
+	middleware := NewRateLimitMiddleware(limiter, logger, WithLegacyHeaders())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		code      int
+		rateLimit string
+		remaining string
+	}{
+		{http.StatusOK, `"default";r=1;t=60`, "1"},
+		{http.StatusOK, `"default";r=0;t=60`, "0"},
+		{http.StatusTooManyRequests, `"default";r=0;t=60`, "0"},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		middleware.Handler(handler).ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("Request %d: expected status code %d, got %d", i+1, tt.code, rec.Code)
+		}
+		if got := rec.Header().Get("RateLimit-Policy"); got != `"default";q=2;w=60` {
+			t.Errorf("Request %d: unexpected RateLimit-Policy header %q", i+1, got)
+		}
+		if got := rec.Header().Get("RateLimit"); got != tt.rateLimit {
+			t.Errorf("Request %d: expected RateLimit header %q, got %q", i+1, tt.rateLimit, got)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("Request %d: expected X-RateLimit-Limit 2, got %q", i+1, got)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("Request %d: expected X-RateLimit-Remaining %s, got %q", i+1, tt.remaining, got)
+		}
+		if rec.Header().Get("X-RateLimit-Reset") == "" {
+			t.Errorf("Request %d: expected X-RateLimit-Reset header", i+1)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareRetryAfter(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	limiter := ratelimiter.New(storage.NewMemoryStorage(),
+		ratelimiter.WithAlgorithm(ratelimiter.TokenBucket),
+		ratelimiter.WithRefillRate(10),
+		ratelimiter.WithBucketCapacity(1),
+	)
+	middleware := NewRateLimitMiddleware(limiter, logger)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		middleware.Handler(handler).ServeHTTP(rec, req)
+
+		if i == 0 {
+			continue
+		}
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("Expected status code %d, got %d", http.StatusTooManyRequests, rec.Code)
+		}
+
+		// A token comes back within 100ms, which rounds up to a second
+		if got := rec.Header().Get("Retry-After"); got != "1" {
+			t.Errorf("Expected Retry-After 1, got %q", got)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareOnLimited(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	storage := &mockStorage{count: 101}
+	limiter := ratelimiter.New(storage)
+	middleware := NewRateLimitMiddleware(limiter, logger, WithOnLimited(func(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header to be set before the handler runs")
+	}
+}
+
+func TestRateLimitMiddlewareFailurePolicy(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	limiter := ratelimiter.New(&failingStorage{})
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		code     int
+		decision Decision
+	}{
+		{"default", nil, http.StatusInternalServerError, DecisionError},
+		{"fail open", []Option{WithFailurePolicy(FailOpen)}, http.StatusOK, DecisionFailedOpen},
+		{"fail closed", []Option{WithFailurePolicy(FailClosed)}, http.StatusServiceUnavailable, DecisionFailedClosed},
+		{"fail closed 429", []Option{WithFailurePolicy(FailClosedTooManyRequests)}, http.StatusTooManyRequests, DecisionFailedClosed},
+		{"fallback", []Option{WithFallbackLimiter(ratelimiter.New(storage.NewMemoryStorage(), ratelimiter.WithMaxRequests(1)))}, http.StatusOK, DecisionFallbackAllowed},
+		{"failing fallback", []Option{WithFallbackLimiter(limiter), WithFailurePolicy(FailOpen)}, http.StatusOK, DecisionFailedOpen},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tt := range tests {
+		var decision Decision
+		opts := append(tt.opts, WithMetrics(MetricsFunc(func(r *http.Request, d Decision) {
+			decision = d
+		})))
+		middleware := NewRateLimitMiddleware(limiter, logger, opts...)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		middleware.Handler(handler).ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected status code %d, got %d", tt.name, tt.code, rec.Code)
+		}
+		if decision != tt.decision {
+			t.Errorf("%s: expected decision %q, got %q", tt.name, tt.decision, decision)
+		}
+	}
+}
+
+func TestRateLimitMiddlewarePolicies(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	store := storage.NewMemoryStorage()
+	router, err := NewPolicyRouter(
+		Policy{Name: "login", Pattern: "POST /login", Limiter: ratelimiter.New(store, ratelimiter.WithMaxRequests(1))},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	middleware := NewRateLimitMiddleware(ratelimiter.New(store), logger, WithPolicyRouter(router))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		policy string
+	}{
+		{"POST", "/login", http.StatusOK, `"login";q=1;w=60`},
+		{"POST", "/login", http.StatusTooManyRequests, `"login";q=1;w=60`},
+		{"GET", "/", http.StatusOK, `"default";q=100;w=60`},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rec := httptest.NewRecorder()
+		middleware.Handler(handler).ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("Request %d: expected status code %d, got %d", i+1, tt.code, rec.Code)
+		}
+		if got := rec.Header().Get("RateLimit-Policy"); got != tt.policy {
+			t.Errorf("Request %d: expected RateLimit-Policy %q, got %q", i+1, tt.policy, got)
+		}
+	}
+
+	// Policy counters are namespaced apart from the default limiter's
+	count, err := store.GetRequests(context.Background(), "login:192.0.2.1")
+	if err != nil {
+		t.Fatalf("Failed to get requests: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 login requests counted, got %d", count)
+	}
+}
+
+func TestRateLimitMiddlewareAccessLists(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	storage := &mockStorage{count: 101}
+	limiter := ratelimiter.New(storage)
+
+	allow := NewAccessList()
+	allow.AddCIDR("10.0.0.0/8")
+	deny := NewAccessList()
+	deny.AddCIDR("10.6.6.6")
+
+	var decision Decision
+	middleware := NewRateLimitMiddleware(limiter, logger, WithAllowList(allow), WithDenyList(deny),
+		WithMetrics(MetricsFunc(func(r *http.Request, d Decision) {
+			decision = d
+		})),
+	)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		remote   string
+		code     int
+		decision Decision
+	}{
+		{"10.1.2.3:1234", http.StatusOK, DecisionBypassed},
+		{"10.6.6.6:1234", http.StatusForbidden, DecisionDenied},
+		{"203.0.113.7:1234", http.StatusTooManyRequests, DecisionLimited},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		middleware.Handler(handler).ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected status code %d, got %d", tt.remote, tt.code, rec.Code)
+		}
+		if decision != tt.decision {
+			t.Errorf("%s: expected decision %q, got %q", tt.remote, tt.decision, decision)
+		}
+	}
+
+	// Lists can change while serving requests
+	deny.RemoveCIDR("10.6.6.6")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.6.6.6:1234"
+	rec := httptest.NewRecorder()
+	middleware.Handler(handler).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected removed address to be allowed, got %d", rec.Code)
+	}
+}
+
 // Mock storage for testing
 type mockStorage struct {
 	count int
+	key   string
 }
 
-func (m *mockStorage) IncrementRequests(key string, now time.Time) (int, error) {
-	m.count++
+func (m *mockStorage) IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	m.key = key
+	m.count += n
 	return m.count, nil
 }
 
-func (m *mockStorage) GetRequests(key string) (int, error) {
+func (m *mockStorage) GetRequests(ctx context.Context, key string) (int, error) {
 	return m.count, nil
 }
 
-func (m *mockStorage) IsBlocked(key string) (bool, time.Time, error) {
+func (m *mockStorage) IsBlocked(ctx context.Context, key string) (bool, time.Time, error) {
 	if m.count > 100 {
 		return true, time.Now().Add(time.Minute), nil
 	}
 	return false, time.Time{}, nil
 }
 
-func (m *mockStorage) Block(key string, until time.Time) error {
+func (m *mockStorage) Block(ctx context.Context, key string, until time.Time) error {
 	return nil
 }
 
-func (m *mockStorage) Reset(key string) error {
+func (m *mockStorage) Reset(ctx context.Context, key string) error {
 	m.count = 0
 	return nil
 }
+
+// Mock storage whose backend is unreachable
+type failingStorage struct{}
+
+var errUnavailable = errors.New("storage unavailable")
+
+func (f *failingStorage) IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	return 0, errUnavailable
+}
+
+func (f *failingStorage) GetRequests(ctx context.Context, key string) (int, error) {
+	return 0, errUnavailable
+}
+
+func (f *failingStorage) IsBlocked(ctx context.Context, key string) (bool, time.Time, error) {
+	return false, time.Time{}, errUnavailable
+}
+
+func (f *failingStorage) Block(ctx context.Context, key string, until time.Time) error {
+	return errUnavailable
+}
+
+func (f *failingStorage) Reset(ctx context.Context, key string) error {
+	return errUnavailable
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Client IP headers understood by IPResolver
+const (
+	HeaderForwarded      = "Forwarded"
+	HeaderXForwardedFor  = "X-Forwarded-For"
+	HeaderXRealIP        = "X-Real-IP"
+	HeaderCFConnectingIP = "CF-Connecting-IP"
+)
+
+// IPResolver resolves the client IP of a request. Headers are only honored
+// when the request comes from a trusted proxy, so clients can't spoof them.
+// The zero value trusts no proxy and uses the connection's remote address.
+type IPResolver struct {
+	trusted []netip.Prefix
+	headers []string
+}
+
+// NewIPResolver creates a resolver trusting proxies in the given CIDRs or
+// addresses. Headers are checked in order and default to Forwarded and
+// X-Forwarded-For.
+func NewIPResolver(trustedProxies []string, headers ...string) (*IPResolver, error) {
+	res := &IPResolver{headers: headers}
+	if len(res.headers) == 0 {
+		res.headers = []string{HeaderForwarded, HeaderXForwardedFor}
+	}
+
+	for _, proxy := range trustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		res.trusted = append(res.trusted, prefix)
+	}
+
+	return res, nil
+}
+
+// ClientIP returns the IP of the client that sent the request
+func (res *IPResolver) ClientIP(r *http.Request) string {
+	remote, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	}
+	if !res.isTrusted(remote) {
+		return remote.String()
+	}
+
+	for _, header := range res.headers {
+		if ip, ok := res.fromHeader(r, header); ok {
+			return ip.String()
+		}
+	}
+	return remote.String()
+}
+
+// Key is a KeyFunc limiting by the resolved client IP
+func (res *IPResolver) Key(r *http.Request) (string, bool) {
+	ip := res.ClientIP(r)
+	return ip, ip != ""
+}
+
+// fromHeader returns the client IP recorded in a header by trusted proxies
+func (res *IPResolver) fromHeader(r *http.Request, header string) (netip.Addr, bool) {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return netip.Addr{}, false
+	}
+
+	switch http.CanonicalHeaderKey(header) {
+	case HeaderForwarded:
+		return res.walk(forwardedFor(values))
+	case HeaderXForwardedFor:
+		var hops []string
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		return res.walk(hops)
+	default:
+		// Single value headers set by the proxy in front of us
+		return parseHost(strings.TrimSpace(values[len(values)-1]))
+	}
+}
+
+// walk returns the rightmost hop not added by a trusted proxy. Every proxy
+// appends the address it received the request from, so hops to the left of
+// the first untrusted one may be spoofed by the client.
+func (res *IPResolver) walk(hops []string) (netip.Addr, bool) {
+	var ip netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHost(strings.TrimSpace(hops[i]))
+		if !ok {
+			// A hop we can't read means the chain can't be followed
+			return netip.Addr{}, false
+		}
+		ip = hop
+		if !res.isTrusted(ip) {
+			break
+		}
+	}
+	return ip, ip.IsValid()
+}
+
+// isTrusted reports whether ip belongs to a trusted proxy
+func (res *IPResolver) isTrusted(ip netip.Addr) bool {
+	for _, prefix := range res.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values (RFC 7239)
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHost parses an IP optionally followed by a port, as in "192.0.2.1:80" or "[2001:db8::1]:80"
+func parseHost(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// parsePrefix parses a CIDR or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// IPPrefix sets how many leading bits of client IPs identify a client. A
+// single IPv6 client usually controls a whole /64, so limiting per address
+// is easy to evade. Zero keeps the full address.
+type IPPrefix struct {
+	IPv4 int
+	IPv6 int
+}
+
+// Mask returns the network of ip at the configured prefix length
+func (p IPPrefix) Mask(ip netip.Addr) netip.Prefix {
+	bits := p.IPv4
+	if ip.Is6() {
+		bits = p.IPv6
+	}
+	if bits <= 0 || bits > ip.BitLen() {
+		bits = ip.BitLen()
+	}
+
+	prefix, _ := ip.WithZone("").Prefix(bits)
+	return prefix
+}
+
+// KeyFromIPPrefix returns a KeyFunc limiting by the network the client IP
+// belongs to, e.g. "2001:db8:1:2::/64". Full length prefixes are keyed by the
+// plain address, as KeyFromIP does.
+func KeyFromIPPrefix(res *IPResolver, p IPPrefix) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		ip := res.ClientIP(r)
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return ip, ip != ""
+		}
+
+		prefix := p.Mask(addr)
+		if prefix.IsSingleIP() {
+			return prefix.Addr().String(), true
+		}
+		return prefix.String(), true
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPResolver(t *testing.T) {
+	res, err := NewIPResolver([]string{"10.0.0.0/8", "192.168.1.1"},
+		HeaderForwarded, HeaderXForwardedFor, HeaderXRealIP, HeaderCFConnectingIP)
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed from untrusted peer", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"multi-hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.9, 10.0.0.2"}, "198.51.100.9"},
+		{"all hops trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 192.168.1.1"}, "10.0.0.3"},
+		{"unreadable hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "garbage, 10.0.0.2"}, "10.0.0.1"},
+		{"forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::1]:4711";proto=https`}, "2001:db8::1"},
+		{"forwarded obfuscated", "10.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden", "X-Real-IP": "198.51.100.9"}, "198.51.100.9"},
+		{"real ip", "192.168.1.1:1234", map[string]string{"X-Real-IP": "198.51.100.9"}, "198.51.100.9"},
+		{"cloudflare", "10.0.0.1:1234", map[string]string{"CF-Connecting-IP": "2001:db8::2"}, "2001:db8::2"},
+		{"mapped ipv4", "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+
+		if got := res.ClientIP(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestIPResolverDefault(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	if got := (&IPResolver{}).ClientIP(req); got != "203.0.113.7" {
+		t.Errorf("Expected headers to be ignored without trusted proxies, got %s", got)
+	}
+}
+
+func TestNewIPResolverInvalidProxy(t *testing.T) {
+	if _, err := NewIPResolver([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected error for invalid trusted proxy")
+	}
+}
+
+func TestKeyFromIPPrefix(t *testing.T) {
+	key := KeyFromIPPrefix(&IPResolver{}, IPPrefix{IPv4: 24, IPv6: 64})
+
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"203.0.113.7:1234", "203.0.113.0/24"},
+		{"[2001:db8:1:2:aaaa::1]:1234", "2001:db8:1:2::/64"},
+		{"[::ffff:203.0.113.7]:1234", "203.0.113.0/24"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+
+		if got, _ := key(req); got != tt.want {
+			t.Errorf("Expected %s for %s, got %s", tt.want, tt.remote, got)
+		}
+	}
+
+	// Unset prefixes keep the full address
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	if got, _ := KeyFromIPPrefix(&IPResolver{}, IPPrefix{IPv6: 64})(req); got != "203.0.113.7" {
+		t.Errorf("Expected full IPv4 address, got %s", got)
+	}
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// KeyFunc extracts the rate limit key from a request. It reports false when
+// the request doesn't carry the key, e.g. a missing header.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// KeyFromIP returns a KeyFunc that limits by the connection's remote IP.
+// Behind proxies use the Key method of an IPResolver instead.
+func KeyFromIP() KeyFunc {
+	return (&IPResolver{}).Key
+}
+
+// KeyFromHeader returns a KeyFunc that limits by the value of a request header, e.g. an API key
+func KeyFromHeader(name string) KeyFunc {
+	name = http.CanonicalHeaderKey(name)
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		return "header:" + name + ":" + value, value != ""
+	}
+}
+
+// KeyFromQuery returns a KeyFunc that limits by the value of a query parameter
+func KeyFromQuery(param string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(param)
+		return "query:" + param + ":" + value, value != ""
+	}
+}
+
+// KeyFromCookie returns a KeyFunc that limits by the value of a cookie
+func KeyFromCookie(name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return "cookie:" + name + ":" + cookie.Value, true
+	}
+}
+
+// KeyFromContext returns a KeyFunc that limits by a value stored in the request
+// context, such as the user ID set by an authentication middleware
+func KeyFromContext(key any) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		value := r.Context().Value(key)
+		if value == nil {
+			return "", false
+		}
+		return fmt.Sprintf("context:%v", value), true
+	}
+}
+
+// KeyFromPathPrefix returns a KeyFunc that limits by the path segment following
+// prefix, e.g. the tenant in /tenants/{tenant}/... with prefix "/tenants/".
+// The request path is matched in its canonical form.
+func KeyFromPathPrefix(prefix string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		rest, ok := strings.CutPrefix(cleanPath(r.URL.Path), prefix)
+		if !ok {
+			return "", false
+		}
+
+		segment, _, _ := strings.Cut(rest, "/")
+		return "path:" + prefix + segment, segment != ""
+	}
+}
+
+// KeyFromMethodRoute returns a KeyFunc that limits by request method and
+// canonical path, usually combined with a client key using CompositeKey
+func KeyFromMethodRoute() KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		return "route:" + r.Method + " " + cleanPath(r.URL.Path), true
+	}
+}
+
+// CompositeKey returns a KeyFunc combining the keys of all fns, e.g. tenant and
+// user. The key is absent if any of them is absent.
+func CompositeKey(fns ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		keys := make([]string, len(fns))
+		for i, fn := range fns {
+			key, ok := fn(r)
+			if !ok {
+				return "", false
+			}
+			keys[i] = key
+		}
+		return strings.Join(keys, "|"), true
+	}
+}
+
+// FirstKey returns a KeyFunc using the first key present among fns, e.g. an API
+// key header falling back to the client IP
+func FirstKey(fns ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		for _, fn := range fns {
+			if key, ok := fn(r); ok {
+				return key, true
+			}
+		}
+		return "", false
+	}
+}
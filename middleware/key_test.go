@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyFuncs(t *testing.T) {
+	type ctxKey struct{}
+
+	req := httptest.NewRequest("GET", "/tenants/acme/users?token=abc", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-API-Key", "secret")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, 42))
+
+	tests := []struct {
+		name string
+		fn   KeyFunc
+		want string
+		ok   bool
+	}{
+		{"ip", KeyFromIP(), "10.0.0.1", true},
+		{"header", KeyFromHeader("x-api-key"), "header:X-Api-Key:secret", true},
+		{"missing header", KeyFromHeader("Authorization"), "", false},
+		{"query", KeyFromQuery("token"), "query:token:abc", true},
+		{"cookie", KeyFromCookie("session"), "cookie:session:s1", true},
+		{"missing cookie", KeyFromCookie("other"), "", false},
+		{"context", KeyFromContext(ctxKey{}), "context:42", true},
+		{"path prefix", KeyFromPathPrefix("/tenants/"), "path:/tenants/acme", true},
+		{"other path", KeyFromPathPrefix("/users/"), "", false},
+		{"method route", KeyFromMethodRoute(), "route:GET /tenants/acme/users", true},
+		{"composite", CompositeKey(KeyFromPathPrefix("/tenants/"), KeyFromHeader("X-API-Key")), "path:/tenants/acme|header:X-Api-Key:secret", true},
+		{"composite missing", CompositeKey(KeyFromPathPrefix("/tenants/"), KeyFromHeader("Authorization")), "", false},
+		{"first", FirstKey(KeyFromHeader("Authorization"), KeyFromIP()), "10.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		key, ok := tt.fn(req)
+		if ok != tt.ok || (ok && key != tt.want) {
+			t.Errorf("%s: expected (%q, %v), got (%q, %v)", tt.name, tt.want, tt.ok, key, ok)
+		}
+	}
+}
+
+func TestKeyFuncsCleanPath(t *testing.T) {
+	// Equivalent paths share their keys
+	for _, target := range []string{"//tenants/acme/users", "/tenants/./acme/users", "/users/../tenants/acme/users"} {
+		req := httptest.NewRequest("GET", target, nil)
+
+		if key, ok := KeyFromPathPrefix("/tenants/")(req); !ok || key != "path:/tenants/acme" {
+			t.Errorf("%s: expected path key %q, got (%q, %v)", target, "path:/tenants/acme", key, ok)
+		}
+		if key, _ := KeyFromMethodRoute()(req); key != "route:GET /tenants/acme/users" {
+			t.Errorf("%s: expected route key %q, got %q", target, "route:GET /tenants/acme/users", key)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+// LimitedHandler writes the response to a request denied by the rate limiter.
+// The Retry-After and RateLimit headers are already set when it is called.
+type LimitedHandler func(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response)
+
+// ProblemDetails is an RFC 9457 problem details body, extended with the client's quota
+type ProblemDetails struct {
+	Type         string    `json:"type"`
+	Title        string    `json:"title"`
+	Status       int       `json:"status"`
+	Detail       string    `json:"detail,omitempty"`
+	Instance     string    `json:"instance,omitempty"`
+	Limit        int       `json:"limit"`
+	RequestsMade int       `json:"requests_made"`
+	RetryAfter   time.Time `json:"retry_after"`
+}
+
+// RespondJSON writes the ErrorResponse JSON body. It is the default LimitedHandler.
+func RespondJSON(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:        "Rate limit exceeded",
+		Limit:        resp.Limit,
+		RequestsMade: resp.RequestsMade,
+		RetryAfter:   resp.RetryAfter,
+	})
+}
+
+// RespondProblem writes an RFC 9457 application/problem+json body
+func RespondProblem(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	json.NewEncoder(w).Encode(ProblemDetails{
+		Type:         "about:blank",
+		Title:        http.StatusText(http.StatusTooManyRequests),
+		Status:       http.StatusTooManyRequests,
+		Detail:       limitedMessage(resp),
+		Instance:     r.URL.Path,
+		Limit:        resp.Limit,
+		RequestsMade: resp.RequestsMade,
+		RetryAfter:   resp.RetryAfter,
+	})
+}
+
+// RespondText writes a plain text body
+func RespondText(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	fmt.Fprintln(w, limitedMessage(resp))
+}
+
+// RespondHTML writes a minimal HTML page
+func RespondHTML(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>Too Many Requests</title></head>
+<body>
+<h1>Too Many Requests</h1>
+<p>%s</p>
+</body>
+</html>
+`, limitedMessage(resp))
+}
+
+// negotiated lists the media types RespondNegotiated serves, in order of preference
+var negotiated = []struct {
+	mediaType string
+	respond   LimitedHandler
+}{
+	{"application/json", RespondJSON},
+	{"application/problem+json", RespondProblem},
+	{"text/plain", RespondText},
+	{"text/html", RespondHTML},
+}
+
+// RespondNegotiated picks the JSON, problem+json, plain text or HTML body
+// according to the request's Accept header, defaulting to JSON
+func RespondNegotiated(w http.ResponseWriter, r *http.Request, resp ratelimiter.Response) {
+	respond := RespondJSON
+	best := 0.0
+	for _, candidate := range negotiated {
+		if q := acceptQuality(r.Header.Values("Accept"), candidate.mediaType); q > best {
+			respond, best = candidate.respond, q
+		}
+	}
+	respond(w, r, resp)
+}
+
+// acceptQuality returns the quality an Accept header gives mediaType, using
+// its most specific matching range
+func acceptQuality(accept []string, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, value := range accept {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			accepted := strings.ToLower(strings.TrimSpace(params[0]))
+
+			var s int
+			switch accepted {
+			case mediaType:
+				s = 2
+			case mainType + "/*":
+				s = 1
+			case "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s <= specificity {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range params[1:] {
+				name, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(name, "q") {
+					if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+			quality, specificity = q, s
+		}
+	}
+	return quality
+}
+
+// limitedMessage describes a denied request for humans
+func limitedMessage(resp ratelimiter.Response) string {
+	wait := int(math.Ceil(time.Until(resp.RetryAfter).Seconds()))
+	if wait <= 0 {
+		return "Rate limit exceeded, please retry."
+	}
+	return fmt.Sprintf("Rate limit exceeded, retry in %d seconds.", wait)
+}
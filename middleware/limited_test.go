@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+func TestRespondNegotiated(t *testing.T) {
+	resp := ratelimiter.Response{Limit: 10, RequestsMade: 11, RetryAfter: time.Now().Add(time.Minute)}
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/problem+json", "application/problem+json"},
+		{"text/plain", "text/plain; charset=utf-8"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"application/json;q=0.5, text/*", "text/plain; charset=utf-8"},
+		{"image/png", "application/json"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		RespondNegotiated(rec, req, resp)
+
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("Accept %q: expected status code %d, got %d", tt.accept, http.StatusTooManyRequests, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Accept %q: expected content type %q, got %q", tt.accept, tt.contentType, got)
+		}
+	}
+}
+
+func TestRespondProblem(t *testing.T) {
+	resp := ratelimiter.Response{Limit: 10, RequestsMade: 11, RetryAfter: time.Now().Add(time.Minute)}
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	rec := httptest.NewRecorder()
+	RespondProblem(rec, req, resp)
+
+	var problem ProblemDetails
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if problem.Status != http.StatusTooManyRequests || problem.Title != "Too Many Requests" || problem.Instance != "/api/users" {
+		t.Errorf("Unexpected problem details %+v", problem)
+	}
+	if problem.Limit != 10 || !strings.Contains(problem.Detail, "retry in 60 seconds") {
+		t.Errorf("Expected quota in problem details, got %+v", problem)
+	}
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// Decision is the outcome of the middleware for a request, as reported to Metrics
+type Decision string
+
+const (
+	DecisionAllowed         Decision = "allowed"          // Allowed by the limiter
+	DecisionLimited         Decision = "limited"          // Over the limit
+	DecisionFallbackAllowed Decision = "fallback_allowed" // Allowed by the fallback limiter after a storage failure
+	DecisionFallbackLimited Decision = "fallback_limited" // Over the fallback limiter's limit after a storage failure
+	DecisionFailedOpen      Decision = "failed_open"      // Let through by FailOpen
+	DecisionFailedClosed    Decision = "failed_closed"    // Rejected by FailClosed or FailClosedTooManyRequests
+	DecisionError           Decision = "error"            // Rejected by FailError
+	DecisionBypassed        Decision = "bypassed"         // Let through unlimited by the allow list
+	DecisionDenied          Decision = "denied"           // Rejected by the deny list
+)
+
+// Metrics receives the decision taken for every request
+type Metrics interface {
+	ObserveDecision(r *http.Request, decision Decision)
+}
+
+// MetricsFunc adapts a function to the Metrics interface
+type MetricsFunc func(r *http.Request, decision Decision)
+
+// ObserveDecision calls f(r, decision)
+func (f MetricsFunc) ObserveDecision(r *http.Request, decision Decision) {
+	f(r, decision)
+}
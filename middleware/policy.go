@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+// Policy applies a RateLimiter to the requests matching a route
+type Policy struct {
+	// Name namespaces the policy's keys, so a client's counters for different
+	// routes don't collide, and names the policy in RateLimit headers
+	Name string
+
+	// Pattern matches the request's method, host and path using http.ServeMux
+	// syntax, e.g. "POST /login", "/api/" or "api.example.com/search/{query}"
+	Pattern string
+
+	// Headers the request must also carry with the given values, e.g. a plan
+	// header set by an API gateway. Values are matched exactly.
+	Headers map[string]string
+
+	Limiter *ratelimiter.RateLimiter
+}
+
+// PolicyRouter picks the Policy of a request. The most specific matching
+// pattern whose headers match wins, following http.ServeMux precedence rules.
+type PolicyRouter struct {
+	mux        *http.ServeMux
+	patterns   []string
+	candidates map[string]policyCandidates
+
+	// fallbacks caches muxes without the patterns whose headers didn't match,
+	// by the excluded patterns joined with newlines
+	fallbacks sync.Map
+}
+
+// policyCandidates is registered in the router's ServeMux for each pattern,
+// holding the policies sharing it in the order they were given
+type policyCandidates []Policy
+
+// ServeHTTP is never called, the router only uses the mux for matching
+func (policyCandidates) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// NewPolicyRouter creates a router for the given policies. Policies sharing a
+// pattern are told apart by their headers and checked in order.
+func NewPolicyRouter(policies ...Policy) (*PolicyRouter, error) {
+	candidates := make(map[string]policyCandidates)
+	var patterns []string
+	for _, policy := range policies {
+		if policy.Name == "" {
+			return nil, errors.New("policy name is required")
+		}
+		if policy.Limiter == nil {
+			return nil, fmt.Errorf("policy %q has no limiter", policy.Name)
+		}
+		if _, ok := candidates[policy.Pattern]; !ok {
+			patterns = append(patterns, policy.Pattern)
+		}
+		candidates[policy.Pattern] = append(candidates[policy.Pattern], policy)
+	}
+
+	router := &PolicyRouter{mux: http.NewServeMux(), patterns: patterns, candidates: candidates}
+	for _, pattern := range patterns {
+		if err := register(router.mux, pattern, candidates[pattern]); err != nil {
+			return nil, err
+		}
+	}
+	return router, nil
+}
+
+// without returns a mux holding every pattern but the excluded ones
+func (pr *PolicyRouter) without(excluded []string) *http.ServeMux {
+	key := strings.Join(excluded, "\n")
+	if mux, ok := pr.fallbacks.Load(key); ok {
+		return mux.(*http.ServeMux)
+	}
+
+	// A subset of valid patterns can't conflict
+	mux := http.NewServeMux()
+	for _, pattern := range pr.patterns {
+		if !slices.Contains(excluded, pattern) {
+			mux.Handle(pattern, pr.candidates[pattern])
+		}
+	}
+	actual, _ := pr.fallbacks.LoadOrStore(key, mux)
+	return actual.(*http.ServeMux)
+}
+
+// register adds a pattern to mux, reporting invalid or conflicting patterns as errors
+func register(mux *http.ServeMux, pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid policy pattern %q: %v", pattern, r)
+		}
+	}()
+
+	mux.Handle(pattern, handler)
+	return nil
+}
+
+// Match returns the policy of a request, or false if no policy applies.
+//
+// Paths are matched in their canonical form, so "//login" and "/a/../login"
+// match the policy of "/login", and "/api" matches that of "/api/" when only
+// the subtree is registered, just like the redirects of an http.ServeMux.
+// Requests whose method no pattern for their path allows, such as GET on
+// "POST /login", match no policy. When the headers of no policy of the most
+// specific pattern match, less specific patterns are tried in turn.
+func (pr *PolicyRouter) Match(r *http.Request) (Policy, bool) {
+	p := cleanPath(r.URL.Path)
+	mux := pr.mux
+	var excluded []string
+	for {
+		candidates, pattern, ok := lookup(mux, r, p)
+		if !ok && !strings.HasSuffix(p, "/") {
+			candidates, pattern, ok = lookup(mux, r, p+"/")
+		}
+		if !ok {
+			return Policy{}, false
+		}
+
+		for _, policy := range candidates {
+			if matchHeaders(r, policy.Headers) {
+				return policy, true
+			}
+		}
+
+		excluded = append(excluded, pattern)
+		mux = pr.without(excluded)
+	}
+}
+
+// lookup returns the policies and pattern mux matches for the request with the given path
+func lookup(mux *http.ServeMux, r *http.Request, p string) (policyCandidates, string, bool) {
+	if p != r.URL.Path {
+		u := *r.URL
+		u.Path, u.RawPath = p, ""
+		r = r.Clone(r.Context())
+		r.URL = &u
+	}
+
+	// Anything else is the mux's own not found, redirect or method not allowed handler
+	h, pattern := mux.Handler(r)
+	candidates, ok := h.(policyCandidates)
+	return candidates, pattern, ok
+}
+
+// cleanPath returns the canonical form of a request path, keeping its trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// matchHeaders reports whether the request carries every header with its value
+func matchHeaders(r *http.Request, headers map[string]string) bool {
+	for name, value := range headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+	"github.com/devfullcycle/ratelimiter/storage"
+)
+
+func TestPolicyRouter(t *testing.T) {
+	limiter := ratelimiter.New(storage.NewMemoryStorage())
+	router, err := NewPolicyRouter(
+		Policy{Name: "login", Pattern: "POST /login", Limiter: limiter},
+		Policy{Name: "search", Pattern: "/api/search", Limiter: limiter},
+		Policy{Name: "partner-api", Pattern: "/api/", Headers: map[string]string{"X-Plan": "partner"}, Limiter: limiter},
+		Policy{Name: "api", Pattern: "/api/", Limiter: limiter},
+		Policy{Name: "admin", Pattern: "admin.example.com/", Limiter: limiter},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		plan   string
+		want   string
+	}{
+		{"POST", "/login", "", "login"},
+		{"GET", "/login", "", ""},
+		{"GET", "/api/search", "", "search"},
+		{"GET", "/api/users/42", "", "api"},
+		{"GET", "/api/users/42", "partner", "partner-api"},
+		{"GET", "http://admin.example.com/users", "", "admin"},
+		{"GET", "/health", "", ""},
+		{"POST", "//login", "", "login"},
+		{"POST", "/a/../login", "", "login"},
+		{"GET", "//login", "", ""},
+		{"PUT", "/login", "", ""},
+		{"GET", "/api", "", "api"},
+		{"GET", "/api//search", "", "search"},
+		{"GET", "/api/./users/../search", "", "search"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.plan != "" {
+			req.Header.Set("X-Plan", tt.plan)
+		}
+
+		policy, ok := router.Match(req)
+		if ok != (tt.want != "") || policy.Name != tt.want {
+			t.Errorf("%s %s: expected policy %q, got %q (matched: %v)", tt.method, tt.target, tt.want, policy.Name, ok)
+		}
+	}
+}
+
+func TestPolicyRouterFallback(t *testing.T) {
+	limiter := ratelimiter.New(storage.NewMemoryStorage())
+	router, err := NewPolicyRouter(
+		Policy{Name: "partner-search", Pattern: "/api/search", Headers: map[string]string{"X-Plan": "partner"}, Limiter: limiter},
+		Policy{Name: "partner-users", Pattern: "/api/users/", Headers: map[string]string{"X-Plan": "partner"}, Limiter: limiter},
+		Policy{Name: "api", Pattern: "/api/", Limiter: limiter},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		target string
+		plan   string
+		want   string
+	}{
+		{"/api/search", "partner", "partner-search"},
+		{"/api/search", "", "api"},
+		{"/api/users/42", "", "api"},
+		{"/api/users/42", "partner", "partner-users"},
+		{"/health", "", ""},
+	}
+
+	// Repeat to use the cached fallbacks
+	for i := 0; i < 2; i++ {
+		for _, tt := range tests {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.plan != "" {
+				req.Header.Set("X-Plan", tt.plan)
+			}
+
+			policy, ok := router.Match(req)
+			if ok != (tt.want != "") || policy.Name != tt.want {
+				t.Errorf("GET %s (plan %q): expected policy %q, got %q (matched: %v)", tt.target, tt.plan, tt.want, policy.Name, ok)
+			}
+		}
+	}
+}
+
+func TestNewPolicyRouterInvalid(t *testing.T) {
+	limiter := ratelimiter.New(storage.NewMemoryStorage())
+
+	if _, err := NewPolicyRouter(Policy{Name: "bad", Pattern: "GET", Limiter: limiter}); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+	if _, err := NewPolicyRouter(Policy{Name: "nameless", Pattern: "/", Limiter: limiter}, Policy{Pattern: "/api/", Limiter: limiter}); err == nil {
+		t.Error("Expected error for policy without a name")
+	}
+	if _, err := NewPolicyRouter(Policy{Name: "unlimited", Pattern: "/"}); err == nil {
+		t.Error("Expected error for policy without a limiter")
+	}
+}
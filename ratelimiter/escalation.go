@@ -0,0 +1,84 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Escalation lengthens the block of keys that keep exceeding the limit with
+// the fixed window algorithm. Offenses are counted per key and forgotten once
+// the key hasn't been blocked for the decay period.
+type Escalation struct {
+	// Durations blocks the first, second, ... offense for the given duration,
+	// repeating the last one, e.g. 1m, 5m, 30m, 24h. Replaces BlockDuration.
+	Durations []time.Duration
+
+	// Multiplier, when Durations is empty, multiplies BlockDuration by this
+	// factor for every repeat offense, up to MaxDuration
+	Multiplier  float64
+	MaxDuration time.Duration
+
+	Decay time.Duration // Period after which offenses are forgotten, defaults to 24 hours
+}
+
+// WithEscalation lengthens the block of repeat offenders
+func WithEscalation(e Escalation) Option {
+	return func(o *Options) {
+		o.Escalation = e
+	}
+}
+
+// enabled reports whether the escalation lengthens any block
+func (e Escalation) enabled() bool {
+	return len(e.Durations) > 0 || e.Multiplier > 1
+}
+
+// decay returns the configured decay period or its default
+func (e Escalation) decay() time.Duration {
+	if e.Decay > 0 {
+		return e.Decay
+	}
+	return 24 * time.Hour
+}
+
+// duration returns the block duration of a key's nth offense
+func (e Escalation) duration(base time.Duration, offense int) time.Duration {
+	if len(e.Durations) > 0 {
+		return e.Durations[min(max(offense, 1), len(e.Durations))-1]
+	}
+
+	d := float64(base) * math.Pow(e.Multiplier, float64(max(offense, 1)-1))
+	if e.MaxDuration > 0 {
+		d = math.Min(d, float64(e.MaxDuration))
+	}
+	// Guard against overflowing time.Duration for long streaks without a cap
+	return time.Duration(math.Min(d, math.MaxInt64))
+}
+
+// blockDuration returns the block duration of a first offense
+func (o Options) blockDuration() time.Duration {
+	if o.Escalation.enabled() {
+		return o.Escalation.duration(o.BlockDuration, 1)
+	}
+	return o.BlockDuration
+}
+
+// escalate records an offense for a key that was just blocked, lengthening
+// the block for repeat offenders, and returns when the block ends
+func (rl *RateLimiter) escalate(ctx context.Context, key string, now time.Time) (time.Time, int, error) {
+	s := rl.storage.(OffenseStorage)
+
+	offenses, err := s.AddOffense(ctx, key, now, rl.opts.Escalation.decay())
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	until := now.Add(rl.opts.Escalation.duration(rl.opts.BlockDuration, offenses))
+	if offenses > 1 {
+		if err := rl.storage.Block(ctx, key, until); err != nil {
+			return time.Time{}, 0, err
+		}
+	}
+	return until, offenses, nil
+}
@@ -0,0 +1,86 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEscalationDuration(t *testing.T) {
+	steps := Escalation{Durations: []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 24 * time.Hour}}
+	multiplied := Escalation{Multiplier: 2, MaxDuration: 5 * time.Minute}
+
+	tests := []struct {
+		escalation Escalation
+		offense    int
+		want       time.Duration
+	}{
+		{steps, 1, time.Minute},
+		{steps, 3, 30 * time.Minute},
+		{steps, 10, 24 * time.Hour},
+		{multiplied, 1, time.Minute},
+		{multiplied, 2, 2 * time.Minute},
+		{multiplied, 4, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := tt.escalation.duration(time.Minute, tt.offense); got != tt.want {
+			t.Errorf("Expected offense %d to block for %v, got %v", tt.offense, tt.want, got)
+		}
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	storage := &mockOffenseStorage{mockStorage: mockStorage{mu: &sync.Mutex{}}}
+	limiter := New(storage, WithMaxRequests(1), WithEscalation(Escalation{
+		Durations: []time.Duration{time.Minute, 5 * time.Minute},
+	}))
+
+	for offense, want := range []time.Duration{time.Minute, 5 * time.Minute} {
+		limiter.Reset("test-ip")
+		limiter.Allow("test-ip")
+
+		resp, err := limiter.Allow("test-ip")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if resp.Allowed {
+			t.Fatal("Expected request over the limit to be denied")
+		}
+		if resp.Offenses != offense+1 {
+			t.Errorf("Expected offense %d, got %d", offense+1, resp.Offenses)
+		}
+		if wait := time.Until(resp.RetryAfter); wait <= want-time.Second || wait > want {
+			t.Errorf("Expected block of %v, got %v", want, wait)
+		}
+		if !storage.blockedUntil.Equal(resp.RetryAfter) {
+			t.Errorf("Expected storage block until %v, got %v", resp.RetryAfter, storage.blockedUntil)
+		}
+	}
+}
+
+func TestEscalationNotSupported(t *testing.T) {
+	limiter := New(&mockStorage{mu: &sync.Mutex{}}, WithEscalation(Escalation{Multiplier: 2}))
+
+	if _, err := limiter.Allow("test-ip"); err != ErrAlgorithmNotSupported {
+		t.Errorf("Expected ErrAlgorithmNotSupported, got %v", err)
+	}
+}
+
+// Mock storage counting offenses for testing
+type mockOffenseStorage struct {
+	mockStorage
+	offenses     int
+	blockedUntil time.Time
+}
+
+func (m *mockOffenseStorage) Block(ctx context.Context, key string, until time.Time) error {
+	m.blockedUntil = until
+	return nil
+}
+
+func (m *mockOffenseStorage) AddOffense(ctx context.Context, key string, now time.Time, decay time.Duration) (int, error) {
+	m.offenses++
+	return m.offenses, nil
+}
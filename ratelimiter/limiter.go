@@ -1,14 +1,74 @@
 package ratelimiter
 
 import (
+	"context"
+	"errors"
 	"time"
 )
 
+// ErrAlgorithmNotSupported is returned when the storage cannot run the selected algorithm
+var ErrAlgorithmNotSupported = errors.New("storage does not support the selected algorithm")
+
+// ErrInvalidCost is returned for requests costing less than one request
+var ErrInvalidCost = errors.New("request cost must be at least 1")
+
+// ErrExceedsLimit is returned for requests costing more than the limit, which are never allowed
+var ErrExceedsLimit = errors.New("request cost exceeds the limit")
+
+// Algorithm identifies the strategy used to limit requests
+type Algorithm int
+
+const (
+	// FixedWindow counts requests in fixed time windows and blocks clients exceeding the limit
+	FixedWindow Algorithm = iota
+	// TokenBucket refills tokens at a steady rate and allows bursts up to the bucket capacity
+	TokenBucket
+	// SlidingWindow weighs the previous window's count to limit requests over any rolling window
+	SlidingWindow
+	// SlidingLog records every request timestamp for exact accounting over the rolling window
+	SlidingLog
+	// GCRA tracks a single theoretical arrival time per key (generic cell rate algorithm)
+	GCRA
+)
+
+// String returns the algorithm name
+func (a Algorithm) String() string {
+	switch a {
+	case FixedWindow:
+		return "fixed_window"
+	case TokenBucket:
+		return "token_bucket"
+	case SlidingWindow:
+		return "sliding_window"
+	case SlidingLog:
+		return "sliding_log"
+	case GCRA:
+		return "gcra"
+	default:
+		return "unknown"
+	}
+}
+
 // Options configures the rate limiter behavior
 type Options struct {
 	MaxRequests   int           // Maximum requests allowed in the time window
 	TimeWindow    time.Duration // Time window for counting requests
 	BlockDuration time.Duration // Duration to block after limit exceeded
+
+	Algorithm      Algorithm // Algorithm used to limit requests
+	RefillRate     float64   // Tokens added per second (token bucket), defaults to MaxRequests per TimeWindow
+	BucketCapacity int       // Maximum tokens in the bucket (token bucket), defaults to MaxRequests
+
+	Rules []Rule // Limits evaluated together, replacing MaxRequests and TimeWindow when set
+
+	Escalation Escalation // Lengthens the block of repeat offenders
+}
+
+// Rule is one of several limits evaluated together for a key, e.g. per second, minute and day
+type Rule struct {
+	Name        string        // Name reported in Response when the rule is the most restrictive
+	MaxRequests int           // Maximum requests allowed in the time window
+	TimeWindow  time.Duration // Time window for counting requests
 }
 
 // Option is a function that configures Options
@@ -35,6 +95,66 @@ func WithBlockDuration(d time.Duration) Option {
 	}
 }
 
+// WithAlgorithm sets the algorithm used to limit requests
+func WithAlgorithm(a Algorithm) Option {
+	return func(o *Options) {
+		o.Algorithm = a
+	}
+}
+
+// WithRefillRate sets the tokens added to the bucket per second
+func WithRefillRate(rate float64) Option {
+	return func(o *Options) {
+		o.RefillRate = rate
+	}
+}
+
+// WithBucketCapacity sets the maximum tokens the bucket can hold
+func WithBucketCapacity(capacity int) Option {
+	return func(o *Options) {
+		o.BucketCapacity = capacity
+	}
+}
+
+// WithRules limits each key by all rules at once. Requests are only counted when they fit
+// within every rule, and rules use fixed windows without blocking.
+func WithRules(rules ...Rule) Option {
+	return func(o *Options) {
+		o.Rules = rules
+	}
+}
+
+// refillRate returns the configured refill rate or the one derived from MaxRequests and TimeWindow
+func (o Options) refillRate() float64 {
+	if o.RefillRate > 0 {
+		return o.RefillRate
+	}
+	return float64(o.MaxRequests) / o.TimeWindow.Seconds()
+}
+
+// bucketCapacity returns the configured bucket capacity or MaxRequests
+func (o Options) bucketCapacity() int {
+	if o.BucketCapacity > 0 {
+		return o.BucketCapacity
+	}
+	return o.MaxRequests
+}
+
+// capacity returns the largest request cost the limiter can ever allow at once
+func (o Options) capacity() int {
+	if len(o.Rules) > 0 {
+		capacity := o.Rules[0].MaxRequests
+		for _, rule := range o.Rules[1:] {
+			capacity = min(capacity, rule.MaxRequests)
+		}
+		return capacity
+	}
+	if o.Algorithm == TokenBucket {
+		return o.bucketCapacity()
+	}
+	return o.MaxRequests
+}
+
 // Response contains the rate limit check result
 type Response struct {
 	Allowed      bool      `json:"allowed"`
@@ -42,6 +162,17 @@ type Response struct {
 	RequestsLeft int       `json:"requests_left"`
 	RequestsMade int       `json:"requests_made"`
 	Limit        int       `json:"limit"`
+	Rule         string    `json:"rule,omitempty"` // Most restrictive rule, when limiting by rules
+
+	// Offenses of a key within the escalation's decay period, counting the
+	// block. Only set on the request that blocks the key: requests rejected
+	// by the block afterwards report zero.
+	Offenses int `json:"offenses,omitempty"`
+
+	// ResetAt is when the full quota is available again, such as the end of a
+	// fixed window. It is zero when the storage doesn't report it.
+	ResetAt time.Time     `json:"reset_at,omitempty"`
+	Window  time.Duration `json:"window,omitempty"` // Period the limit applies to
 }
 
 // RateLimiter provides rate limiting functionality
@@ -70,8 +201,91 @@ func New(storage Storage, opts ...Option) *RateLimiter {
 
 // Allow checks if a request is allowed for the given key
 func (rl *RateLimiter) Allow(key string) (Response, error) {
+	return rl.AllowContext(context.Background(), key)
+}
+
+// AllowContext checks if a request is allowed for the given key, passing ctx to the storage
+func (rl *RateLimiter) AllowContext(ctx context.Context, key string) (Response, error) {
+	return rl.AllowNContext(ctx, key, 1)
+}
+
+// AllowN checks if a request costing n requests is allowed for the given key
+func (rl *RateLimiter) AllowN(key string, n int) (Response, error) {
+	return rl.AllowNContext(context.Background(), key, n)
+}
+
+// AllowNContext checks if a request costing n requests is allowed for the given key,
+// passing ctx to the storage. A request costing more than the limit is never allowed,
+// so it fails with ErrExceedsLimit without being counted.
+func (rl *RateLimiter) AllowNContext(ctx context.Context, key string, n int) (Response, error) {
+	return rl.allowN(ctx, key, time.Now(), n)
+}
+
+// allowN checks a request costing n counted at now
+func (rl *RateLimiter) allowN(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	if n < 1 {
+		return Response{}, ErrInvalidCost
+	}
+	if n > rl.opts.capacity() {
+		return Response{}, ErrExceedsLimit
+	}
+
+	if len(rl.opts.Rules) > 0 {
+		return rl.allowRules(ctx, key, now, n)
+	}
+
+	switch rl.opts.Algorithm {
+	case TokenBucket:
+		return rl.allowTokenBucket(ctx, key, now, n)
+	case SlidingWindow:
+		return rl.allowSlidingWindow(ctx, key, now, n)
+	case SlidingLog:
+		return rl.allowSlidingLog(ctx, key, now, n)
+	case GCRA:
+		return rl.allowGCRA(ctx, key, now, n)
+	default:
+		return rl.allowFixedWindow(ctx, key, now, n)
+	}
+}
+
+// allowFixedWindow counts the request in the current window and blocks the key once the limit is exceeded
+func (rl *RateLimiter) allowFixedWindow(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	escalate := rl.opts.Escalation.enabled()
+	if _, ok := rl.storage.(OffenseStorage); escalate && !ok {
+		return Response{}, ErrAlgorithmNotSupported
+	}
+
+	// Let the storage take the whole decision atomically when it can
+	if s, ok := rl.storage.(FixedWindowStorage); ok {
+		result, err := s.AllowFixedWindow(ctx, key, now, rl.opts.TimeWindow, rl.opts.MaxRequests, rl.opts.blockDuration(), n)
+		if err != nil {
+			return Response{}, err
+		}
+
+		resp := Response{
+			Allowed:      result.Allowed,
+			RetryAfter:   result.RetryAfter,
+			RequestsLeft: result.Remaining,
+			RequestsMade: result.Count,
+			Limit:        rl.opts.MaxRequests,
+			ResetAt:      result.ResetAt,
+			Window:       rl.opts.TimeWindow,
+		}
+
+		// Requests counted past the limit are the ones blocking the key, later
+		// ones are rejected by the block without being counted
+		if escalate && !result.Allowed && result.Count > rl.opts.MaxRequests {
+			until, offenses, err := rl.escalate(ctx, key, now)
+			if err != nil {
+				return Response{}, err
+			}
+			resp.RetryAfter, resp.ResetAt, resp.Offenses = until, until, offenses
+		}
+		return resp, nil
+	}
+
 	// Check if key is blocked first
-	blocked, retryAfter, err := rl.storage.IsBlocked(key)
+	blocked, retryAfter, err := rl.storage.IsBlocked(ctx, key)
 	if err != nil {
 		return Response{}, err
 	}
@@ -83,11 +297,13 @@ func (rl *RateLimiter) Allow(key string) (Response, error) {
 			RequestsLeft: 0,
 			RequestsMade: rl.opts.MaxRequests,
 			Limit:        rl.opts.MaxRequests,
+			ResetAt:      retryAfter,
+			Window:       rl.opts.TimeWindow,
 		}, nil
 	}
 
 	// Increment request count atomically
-	count, err := rl.storage.IncrementRequests(key, time.Now())
+	count, err := rl.storage.IncrementRequests(ctx, key, now, rl.opts.TimeWindow, n)
 	if err != nil {
 		return Response{}, err
 	}
@@ -99,25 +315,155 @@ func (rl *RateLimiter) Allow(key string) (Response, error) {
 			RequestsLeft: rl.opts.MaxRequests - count,
 			RequestsMade: count,
 			Limit:        rl.opts.MaxRequests,
+			Window:       rl.opts.TimeWindow,
 		}, nil
 	}
 
 	// Block only after MaxRequests exceeded
-	blockUntil := time.Now().Add(rl.opts.BlockDuration)
-	if err := rl.storage.Block(key, blockUntil); err != nil {
+	blockUntil := now.Add(rl.opts.blockDuration())
+	if err := rl.storage.Block(ctx, key, blockUntil); err != nil {
 		return Response{}, err
 	}
 
+	var offenses int
+	if escalate {
+		if blockUntil, offenses, err = rl.escalate(ctx, key, now); err != nil {
+			return Response{}, err
+		}
+	}
+
 	return Response{
 		Allowed:      false,
 		RetryAfter:   blockUntil,
 		RequestsLeft: 0,
 		RequestsMade: count,
 		Limit:        rl.opts.MaxRequests,
+		ResetAt:      blockUntil,
+		Window:       rl.opts.TimeWindow,
+		Offenses:     offenses,
 	}, nil
 }
 
+// allowTokenBucket takes n tokens from the key's bucket
+func (rl *RateLimiter) allowTokenBucket(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	s, ok := rl.storage.(TokenBucketStorage)
+	if !ok {
+		return Response{}, ErrAlgorithmNotSupported
+	}
+
+	capacity, rate := rl.opts.bucketCapacity(), rl.opts.refillRate()
+	result, err := s.AllowTokenBucket(ctx, key, now, rate, capacity, n)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// The bucket's window is the time it takes to refill from empty
+	window := time.Duration(float64(capacity) / rate * float64(time.Second))
+	return newResponse(result, capacity, window), nil
+}
+
+// allowSlidingWindow counts the request if the weighted count over the rolling window is below the limit
+func (rl *RateLimiter) allowSlidingWindow(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	s, ok := rl.storage.(SlidingWindowStorage)
+	if !ok {
+		return Response{}, ErrAlgorithmNotSupported
+	}
+
+	result, err := s.AllowSlidingWindow(ctx, key, now, rl.opts.TimeWindow, rl.opts.MaxRequests, n)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return newResponse(result, rl.opts.MaxRequests, rl.opts.TimeWindow), nil
+}
+
+// allowSlidingLog records the request if fewer than MaxRequests were made in the rolling window
+func (rl *RateLimiter) allowSlidingLog(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	s, ok := rl.storage.(SlidingLogStorage)
+	if !ok {
+		return Response{}, ErrAlgorithmNotSupported
+	}
+
+	result, err := s.AllowSlidingLog(ctx, key, now, rl.opts.TimeWindow, rl.opts.MaxRequests, n)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return newResponse(result, rl.opts.MaxRequests, rl.opts.TimeWindow), nil
+}
+
+// allowGCRA advances the key's theoretical arrival time if the request conforms to the rate
+func (rl *RateLimiter) allowGCRA(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	s, ok := rl.storage.(GCRAStorage)
+	if !ok {
+		return Response{}, ErrAlgorithmNotSupported
+	}
+
+	result, err := s.AllowGCRA(ctx, key, now, rl.opts.TimeWindow, rl.opts.MaxRequests, n)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return newResponse(result, rl.opts.MaxRequests, rl.opts.TimeWindow), nil
+}
+
+// allowRules counts the request against every rule and reports the most restrictive one
+func (rl *RateLimiter) allowRules(ctx context.Context, key string, now time.Time, n int) (Response, error) {
+	s, ok := rl.storage.(RulesStorage)
+	if !ok {
+		return Response{}, ErrAlgorithmNotSupported
+	}
+
+	allowed, states, err := s.AllowRules(ctx, key, now, rl.opts.Rules, n)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// Report the rule with the fewest requests left, or the tripped rule that resets last
+	var resp Response
+	for i, rule := range rl.opts.Rules {
+		state := states[i]
+		left := max(rule.MaxRequests-state.Count, 0)
+
+		if allowed {
+			if i == 0 || left < resp.RequestsLeft {
+				resp = Response{Allowed: true, RequestsLeft: left, RequestsMade: state.Count, Limit: rule.MaxRequests, Rule: rule.Name, ResetAt: state.ResetAt, Window: rule.TimeWindow}
+			}
+			continue
+		}
+
+		if state.Count+n > rule.MaxRequests && state.ResetAt.After(resp.RetryAfter) {
+			resp = Response{RetryAfter: state.ResetAt, RequestsMade: state.Count, Limit: rule.MaxRequests, Rule: rule.Name, ResetAt: state.ResetAt, Window: rule.TimeWindow}
+		}
+	}
+
+	return resp, nil
+}
+
+// newResponse builds a Response from a storage Result
+func newResponse(result Result, limit int, window time.Duration) Response {
+	return Response{
+		Allowed:      result.Allowed,
+		RetryAfter:   result.RetryAfter,
+		RequestsLeft: result.Remaining,
+		RequestsMade: limit - result.Remaining,
+		Limit:        limit,
+		ResetAt:      result.ResetAt,
+		Window:       window,
+	}
+}
+
 // Reset resets the rate limit for a given key
 func (rl *RateLimiter) Reset(key string) error {
-	return rl.storage.Reset(key)
+	return rl.ResetContext(context.Background(), key)
+}
+
+// ResetContext resets the rate limit for a given key, passing ctx to the storage
+func (rl *RateLimiter) ResetContext(ctx context.Context, key string) error {
+	if s, ok := rl.storage.(RulesStorage); ok && len(rl.opts.Rules) > 0 {
+		if err := s.ResetRules(ctx, key, rl.opts.Rules); err != nil {
+			return err
+		}
+	}
+	return rl.storage.Reset(ctx, key)
 }
@@ -1,6 +1,7 @@
 package ratelimiter
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -76,26 +77,193 @@ func TestConcurrentRequests(t *testing.T) {
 	}
 }
 
+func TestTimeWindowPassedToStorage(t *testing.T) {
+	storage := &mockStorage{
+		mu: &sync.Mutex{},
+	}
+	limiter := New(storage, WithTimeWindow(time.Hour))
+
+	if _, err := limiter.Allow("test-ip"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if storage.window != time.Hour {
+		t.Errorf("Expected storage to count requests in a %v window, got %v", time.Hour, storage.window)
+	}
+}
+
+func TestAllowContext(t *testing.T) {
+	storage := &mockStorage{
+		mu: &sync.Mutex{},
+	}
+	limiter := New(storage)
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace")
+	if _, err := limiter.AllowContext(ctx, "test-ip"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if storage.ctx == nil || storage.ctx.Value(ctxKey{}) != "trace" {
+		t.Error("Expected request context to be passed to storage")
+	}
+}
+
+func TestLegacyStorage(t *testing.T) {
+	storage := &mockLegacyStorage{}
+	limiter := New(FromLegacy(storage))
+
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !resp.Allowed || storage.count != 1 {
+		t.Errorf("Expected request to be counted by the legacy storage, got %+v", resp)
+	}
+}
+
+func TestFixedWindowStorage(t *testing.T) {
+	storage := &mockFixedWindowStorage{mockStorage: mockStorage{mu: &sync.Mutex{}}}
+	limiter := New(storage, WithMaxRequests(10))
+
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !resp.Allowed || resp.RequestsMade != 1 || resp.RequestsLeft != 9 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if resp.ResetAt.IsZero() || resp.Window != time.Minute {
+		t.Errorf("Expected the window and its reset time to be reported, got %+v", resp)
+	}
+	if storage.count != 0 {
+		t.Error("Expected the atomic storage call to be used instead of IncrementRequests")
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules := []Rule{
+		{Name: "second", MaxRequests: 10, TimeWindow: time.Second},
+		{Name: "minute", MaxRequests: 500, TimeWindow: time.Minute},
+		{Name: "day", MaxRequests: 20000, TimeWindow: 24 * time.Hour},
+	}
+	now := time.Now()
+	storage := &mockRulesStorage{
+		allowed: true,
+		states: []RuleState{
+			{Count: 3, ResetAt: now.Add(time.Second)},
+			{Count: 498, ResetAt: now.Add(time.Minute)},
+			{Count: 1000, ResetAt: now.Add(time.Hour)},
+		},
+	}
+	limiter := New(storage, WithRules(rules...))
+
+	// The rule with the fewest requests left is reported
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !resp.Allowed || resp.Rule != "minute" || resp.RequestsLeft != 2 || resp.Limit != 500 {
+		t.Errorf("Expected the per-minute rule to be the most restrictive, got %+v", resp)
+	}
+
+	// Among tripped rules, the one resetting last sets RetryAfter
+	storage.allowed = false
+	storage.states = []RuleState{
+		{Count: 10, ResetAt: now.Add(time.Second)},
+		{Count: 500, ResetAt: now.Add(time.Minute)},
+		{Count: 1000, ResetAt: now.Add(time.Hour)},
+	}
+	resp, err = limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed || resp.Rule != "minute" || !resp.RetryAfter.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the per-minute rule to be reported as tripped, got %+v", resp)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	// Storage without token bucket support
+	limiter := New(&mockStorage{mu: &sync.Mutex{}}, WithAlgorithm(TokenBucket))
+	if _, err := limiter.Allow("test-ip"); err != ErrAlgorithmNotSupported {
+		t.Errorf("Expected ErrAlgorithmNotSupported, got %v", err)
+	}
+
+	storage := &mockTokenBucketStorage{mockStorage: mockStorage{mu: &sync.Mutex{}}}
+	limiter = New(storage,
+		WithAlgorithm(TokenBucket),
+		WithMaxRequests(60),
+		WithTimeWindow(time.Minute),
+		WithBucketCapacity(10),
+	)
+
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !resp.Allowed {
+		t.Error("Expected request to be allowed")
+	}
+	if storage.rate != 1 {
+		t.Errorf("Expected refill rate derived from MaxRequests/TimeWindow to be 1, got %v", storage.rate)
+	}
+	if resp.Limit != 10 || resp.RequestsLeft != 9 || resp.RequestsMade != 1 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestAllowNCost(t *testing.T) {
+	storage := &mockStorage{mu: &sync.Mutex{}}
+	limiter := New(storage, WithMaxRequests(10))
+
+	for _, n := range []int{0, -1} {
+		if _, err := limiter.AllowN("test-ip", n); err != ErrInvalidCost {
+			t.Errorf("Expected ErrInvalidCost for cost %d, got %v", n, err)
+		}
+		if _, err := limiter.ReserveNContext(context.Background(), "test-ip", n); err != ErrInvalidCost {
+			t.Errorf("Expected ErrInvalidCost reserving cost %d, got %v", n, err)
+		}
+	}
+
+	// Requests costing more than the limit fail without being counted
+	if _, err := limiter.AllowN("test-ip", 11); err != ErrExceedsLimit {
+		t.Errorf("Expected ErrExceedsLimit, got %v", err)
+	}
+	if storage.count != 0 {
+		t.Errorf("Expected request over the limit not to be counted, got %d", storage.count)
+	}
+
+	// The token bucket is limited by its capacity
+	limiter = New(&mockTokenBucketStorage{mockStorage: mockStorage{mu: &sync.Mutex{}}},
+		WithAlgorithm(TokenBucket), WithMaxRequests(60), WithBucketCapacity(5))
+	if resp, _ := limiter.AllowN("test-ip", 6); resp.Allowed {
+		t.Error("Expected request over the bucket capacity to be denied")
+	}
+}
+
 // Mock storage for testing
 type mockStorage struct {
-	count int
-	mu    *sync.Mutex
+	count  int
+	window time.Duration
+	ctx    context.Context
+	mu     *sync.Mutex
 }
 
-func (m *mockStorage) IncrementRequests(key string, now time.Time) (int, error) {
+func (m *mockStorage) IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.count++
+	m.window = window
+	m.ctx = ctx
+	m.count += n
 	return m.count, nil
 }
 
-func (m *mockStorage) GetRequests(key string) (int, error) {
+func (m *mockStorage) GetRequests(ctx context.Context, key string) (int, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	return m.count, nil
 }
 
-func (m *mockStorage) IsBlocked(key string) (bool, time.Time, error) {
+func (m *mockStorage) IsBlocked(ctx context.Context, key string) (bool, time.Time, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.count > 100 {
@@ -104,13 +272,84 @@ func (m *mockStorage) IsBlocked(key string) (bool, time.Time, error) {
 	return false, time.Time{}, nil
 }
 
-func (m *mockStorage) Block(key string, until time.Time) error {
+func (m *mockStorage) Block(ctx context.Context, key string, until time.Time) error {
 	return nil
 }
 
-func (m *mockStorage) Reset(key string) error {
+func (m *mockStorage) Reset(ctx context.Context, key string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.count = 0
 	return nil
 }
+
+func (m *mockStorage) RefundFixedWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.count -= n
+	return nil
+}
+
+// Mock token bucket storage for testing
+type mockTokenBucketStorage struct {
+	mockStorage
+	rate float64
+}
+
+func (m *mockTokenBucketStorage) AllowTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) (Result, error) {
+	m.rate = rate
+	return Result{Allowed: true, Remaining: capacity - n}, nil
+}
+
+// Mock storage written against the original interface, without context and time window, for testing
+type mockLegacyStorage struct {
+	count int
+}
+
+var _ LegacyStorage = (*mockLegacyStorage)(nil)
+
+func (m *mockLegacyStorage) IncrementRequests(key string, now time.Time) (int, error) {
+	m.count++
+	return m.count, nil
+}
+
+func (m *mockLegacyStorage) GetRequests(key string) (int, error) {
+	return m.count, nil
+}
+
+func (m *mockLegacyStorage) IsBlocked(key string) (bool, time.Time, error) {
+	return false, time.Time{}, nil
+}
+
+func (m *mockLegacyStorage) Block(key string, until time.Time) error {
+	return nil
+}
+
+func (m *mockLegacyStorage) Reset(key string) error {
+	m.count = 0
+	return nil
+}
+
+// Mock atomic fixed window storage for testing
+type mockFixedWindowStorage struct {
+	mockStorage
+}
+
+func (m *mockFixedWindowStorage) AllowFixedWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (Result, error) {
+	return Result{Allowed: true, Remaining: limit - n, Count: n, ResetAt: now.Add(window)}, nil
+}
+
+// Mock rules storage for testing
+type mockRulesStorage struct {
+	mockStorage
+	allowed bool
+	states  []RuleState
+}
+
+func (m *mockRulesStorage) AllowRules(ctx context.Context, key string, now time.Time, rules []Rule, n int) (bool, []RuleState, error) {
+	return m.allowed, m.states, nil
+}
+
+func (m *mockRulesStorage) ResetRules(ctx context.Context, key string, rules []Rule) error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrWaitExceedsDeadline is returned by Wait when the next retry is past the context deadline
+var ErrWaitExceedsDeadline = errors.New("wait would exceed context deadline")
+
+// Reservation is the outcome of Reserve. An OK reservation has already taken
+// capacity from the limiter, which Cancel gives back if the request is dropped.
+type Reservation struct {
+	limiter *RateLimiter
+	key     string
+	n       int
+	resp    Response
+	counted time.Time // when the request was counted, which identifies its window
+
+	mu       sync.Mutex
+	canceled bool
+}
+
+// OK reports whether the reservation took capacity and the request can proceed now
+func (r *Reservation) OK() bool {
+	return r.resp.Allowed
+}
+
+// Delay returns how long to wait before retrying a reservation that isn't OK
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(time.Now())
+}
+
+// DelayFrom returns how long after now to wait before retrying a reservation that isn't OK
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if r.resp.Allowed || r.resp.RetryAfter.Before(now) {
+		return 0
+	}
+	return r.resp.RetryAfter.Sub(now)
+}
+
+// Response returns the rate limit check result behind the reservation
+func (r *Reservation) Response() Response {
+	return r.resp
+}
+
+// Cancel returns the capacity taken by an OK reservation to the limiter
+func (r *Reservation) Cancel() error {
+	return r.CancelContext(context.Background())
+}
+
+// CancelContext returns the capacity taken by an OK reservation to the limiter,
+// passing ctx to the storage. Canceling more than once has no further effect.
+//
+// Capacity is only returned while the window the request was counted in is
+// current, and only by storages implementing the refunder interface of the
+// limiter's algorithm. Other storages keep it.
+func (r *Reservation) CancelContext(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.resp.Allowed || r.canceled {
+		return nil
+	}
+
+	if err := r.limiter.refund(ctx, r.key, r.counted, r.n); err != nil {
+		return fmt.Errorf("failed to cancel reservation: %w", err)
+	}
+	r.canceled = true
+	return nil
+}
+
+// Reserve takes capacity for a request on the given key, or reports how long to wait for it
+func (rl *RateLimiter) Reserve(key string) (*Reservation, error) {
+	return rl.ReserveNContext(context.Background(), key, 1)
+}
+
+// ReserveNContext takes capacity for a request costing n on the given key, or reports
+// how long to wait for it, passing ctx to the storage
+func (rl *RateLimiter) ReserveNContext(ctx context.Context, key string, n int) (*Reservation, error) {
+	now := time.Now()
+	resp, err := rl.allowN(ctx, key, now, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reservation{
+		limiter: rl,
+		key:     key,
+		n:       n,
+		resp:    resp,
+		counted: now,
+	}, nil
+}
+
+// Wait blocks until a request on the given key is allowed or ctx is done
+func (rl *RateLimiter) Wait(ctx context.Context, key string) error {
+	return rl.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until a request costing n on the given key is allowed or ctx is done.
+// It returns ErrExceedsLimit at once if n is more than the limit.
+func (rl *RateLimiter) WaitN(ctx context.Context, key string, n int) error {
+	for {
+		r, err := rl.ReserveNContext(ctx, key, n)
+		if err != nil {
+			return err
+		}
+		if r.OK() {
+			return nil
+		}
+
+		// Don't wait for a retry the context won't live to see
+		delay := max(r.Delay(), time.Millisecond)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return ErrWaitExceedsDeadline
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// refund returns capacity taken by an allowed request costing n counted at counted
+func (rl *RateLimiter) refund(ctx context.Context, key string, counted time.Time, n int) error {
+	now := time.Now()
+
+	if len(rl.opts.Rules) > 0 {
+		if s, ok := rl.storage.(RulesRefunder); ok {
+			return s.RefundRules(ctx, key, now, counted, rl.opts.Rules, n)
+		}
+		return nil
+	}
+
+	switch rl.opts.Algorithm {
+	case TokenBucket:
+		if s, ok := rl.storage.(TokenBucketRefunder); ok {
+			return s.RefundTokenBucket(ctx, key, now, rl.opts.refillRate(), rl.opts.bucketCapacity(), n)
+		}
+	case SlidingWindow:
+		if s, ok := rl.storage.(SlidingWindowRefunder); ok {
+			return s.RefundSlidingWindow(ctx, key, now, counted, rl.opts.TimeWindow, n)
+		}
+	case SlidingLog:
+		if s, ok := rl.storage.(SlidingLogRefunder); ok {
+			return s.RefundSlidingLog(ctx, key, now, counted, rl.opts.TimeWindow, n)
+		}
+	case GCRA:
+		if s, ok := rl.storage.(GCRARefunder); ok {
+			return s.RefundGCRA(ctx, key, now, rl.opts.TimeWindow, rl.opts.MaxRequests, n)
+		}
+	default:
+		if s, ok := rl.storage.(FixedWindowRefunder); ok {
+			return s.RefundFixedWindow(ctx, key, now, counted, rl.opts.TimeWindow, n)
+		}
+	}
+	return nil
+}
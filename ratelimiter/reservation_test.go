@@ -0,0 +1,115 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveCancel(t *testing.T) {
+	storage := &mockStorage{
+		mu: &sync.Mutex{},
+	}
+	limiter := New(storage)
+
+	r, err := limiter.Reserve("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !r.OK() || r.Delay() != 0 {
+		t.Errorf("Expected reservation to be OK without delay, got %+v", r.Response())
+	}
+	if storage.count != 1 {
+		t.Errorf("Expected reservation to take capacity, got count %d", storage.count)
+	}
+
+	// Canceling gives the capacity back once
+	for i := 0; i < 2; i++ {
+		if err := r.Cancel(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if storage.count != 0 {
+			t.Errorf("Expected canceled reservation to return capacity, got count %d", storage.count)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	storage := &mockPacingStorage{
+		mockStorage: mockStorage{mu: &sync.Mutex{}},
+		denials:     1,
+		retryIn:     20 * time.Millisecond,
+	}
+	limiter := New(storage, WithAlgorithm(TokenBucket))
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), "test-ip"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected Wait to pace the request, returned after %v", elapsed)
+	}
+	if storage.calls != 2 {
+		t.Errorf("Expected a single retry, got %d calls", storage.calls)
+	}
+}
+
+func TestWaitExceedsDeadline(t *testing.T) {
+	storage := &mockPacingStorage{
+		mockStorage: mockStorage{mu: &sync.Mutex{}},
+		denials:     1,
+		retryIn:     time.Hour,
+	}
+	limiter := New(storage, WithAlgorithm(TokenBucket))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx, "test-ip"); err != ErrWaitExceedsDeadline {
+		t.Errorf("Expected ErrWaitExceedsDeadline, got %v", err)
+	}
+}
+
+func TestWaitExceedsLimit(t *testing.T) {
+	storage := &mockStorage{mu: &sync.Mutex{}}
+	limiter := New(storage, WithMaxRequests(10))
+
+	if err := limiter.WaitN(context.Background(), "test-ip", 11); err != ErrExceedsLimit {
+		t.Errorf("Expected ErrExceedsLimit, got %v", err)
+	}
+	if storage.count != 0 {
+		t.Errorf("Expected request over the limit not to be counted, got %d", storage.count)
+	}
+}
+
+func TestCancelWithoutRefunder(t *testing.T) {
+	storage := &mockTokenBucketStorage{mockStorage: mockStorage{mu: &sync.Mutex{}}}
+	limiter := New(storage, WithAlgorithm(TokenBucket))
+
+	r, err := limiter.Reserve("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Storages that can't refund keep the capacity
+	if err := r.Cancel(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+// Mock storage denying the first requests for testing
+type mockPacingStorage struct {
+	mockStorage
+	calls   int
+	denials int
+	retryIn time.Duration
+}
+
+func (m *mockPacingStorage) AllowTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) (Result, error) {
+	m.calls++
+	if m.calls <= m.denials {
+		return Result{Allowed: false, RetryAfter: now.Add(m.retryIn)}, nil
+	}
+	return Result{Allowed: true, Remaining: capacity - n}, nil
+}
@@ -1,21 +1,198 @@
 package ratelimiter
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
-// Storage defines the interface for rate limit data storage
+// Storage defines the interface for rate limit data storage. The context
+// carries the caller's deadline and cancellation into backend calls.
+//
+// Methods taking a request cost n, here and in the algorithm interfaces below,
+// are only called with n of at least 1.
 type Storage interface {
-	// IncrementRequests increments the request count for a key and returns the new count
-	IncrementRequests(key string, now time.Time) (int, error)
+	// IncrementRequests increments the request count for a key by n in the window starting
+	// with its first request and returns the new count
+	IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (int, error)
 
 	// GetRequests returns the current request count for a key
-	GetRequests(key string) (int, error)
+	GetRequests(ctx context.Context, key string) (int, error)
 
 	// IsBlocked checks if a key is blocked and returns when it can retry
-	IsBlocked(key string) (blocked bool, retryAfter time.Time, err error)
+	IsBlocked(ctx context.Context, key string) (blocked bool, retryAfter time.Time, err error)
 
 	// Block marks a key as blocked until the specified time
-	Block(key string, until time.Time) error
+	Block(ctx context.Context, key string, until time.Time) error
 
 	// Reset resets all rate limit data for a key
+	Reset(ctx context.Context, key string) error
+}
+
+// Result is the outcome of a rate limit decision taken by a storage
+type Result struct {
+	Allowed    bool      // Whether the request was allowed
+	Remaining  int       // Requests left before the limit is reached
+	RetryAfter time.Time // When a denied request can be retried
+	Count      int       // Requests counted in the current window, for fixed windows
+	ResetAt    time.Time // When the key's full quota is available again
+}
+
+// FixedWindowStorage is implemented by storages that run the whole fixed window check,
+// increment and block decision atomically. RateLimiter prefers it over the separate
+// Storage calls when available.
+type FixedWindowStorage interface {
+	// AllowFixedWindow rejects blocked keys, counts a request of cost n in the current window
+	// and blocks the key for blockDuration once the count exceeds limit
+	AllowFixedWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (Result, error)
+}
+
+// RuleState is the state of a Rule's current window after a multi-limit check
+type RuleState struct {
+	Count   int       // Requests counted in the rule's current window
+	ResetAt time.Time // When the rule's current window resets
+}
+
+// RulesStorage is implemented by storages that evaluate several fixed window rules for a key atomically
+type RulesStorage interface {
+	// AllowRules counts a request of cost n in every rule's window only if it fits within all
+	// of them, and returns the state of each rule in order
+	AllowRules(ctx context.Context, key string, now time.Time, rules []Rule, n int) (allowed bool, states []RuleState, err error)
+
+	// ResetRules resets the windows of the given rules for a key
+	ResetRules(ctx context.Context, key string, rules []Rule) error
+}
+
+// TokenBucketStorage is implemented by storages that support the token bucket algorithm
+type TokenBucketStorage interface {
+	// AllowTokenBucket refills the bucket for a key at rate tokens per second, up to capacity,
+	// and takes n tokens if available
+	AllowTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) (Result, error)
+}
+
+// SlidingWindowStorage is implemented by storages that support the sliding window counter algorithm
+type SlidingWindowStorage interface {
+	// AllowSlidingWindow weighs the previous window's count by its overlap with the rolling window
+	// ending at now and counts a request of cost n if it fits within limit
+	AllowSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (Result, error)
+}
+
+// SlidingLogStorage is implemented by storages that support the sliding window log algorithm
+type SlidingLogStorage interface {
+	// AllowSlidingLog prunes timestamps older than window and records n entries if they fit
+	// within limit
+	AllowSlidingLog(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (Result, error)
+}
+
+// GCRAStorage is implemented by storages that support the generic cell rate algorithm
+type GCRAStorage interface {
+	// AllowGCRA emits requests every window/limit and allows bursts of up to limit requests,
+	// storing only the theoretical arrival time of the next request for a key. A request of
+	// cost n counts as n requests.
+	AllowGCRA(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (Result, error)
+}
+
+// FixedWindowRefunder is implemented by storages that can give back requests counted in a
+// fixed window, such as those of a canceled Reservation. It serves both IncrementRequests
+// and AllowFixedWindow.
+type FixedWindowRefunder interface {
+	// RefundFixedWindow uncounts n requests counted at counted, unless the key's window
+	// has reset since
+	RefundFixedWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error
+}
+
+// RulesRefunder is implemented by storages that can give back requests counted by AllowRules
+type RulesRefunder interface {
+	// RefundRules uncounts n requests counted at counted from every rule whose window
+	// hasn't reset since
+	RefundRules(ctx context.Context, key string, now, counted time.Time, rules []Rule, n int) error
+}
+
+// TokenBucketRefunder is implemented by storages that can give back tokens taken by AllowTokenBucket
+type TokenBucketRefunder interface {
+	// RefundTokenBucket puts n tokens back in the key's bucket, up to capacity
+	RefundTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) error
+}
+
+// SlidingWindowRefunder is implemented by storages that can give back requests counted by AllowSlidingWindow
+type SlidingWindowRefunder interface {
+	// RefundSlidingWindow uncounts n requests counted at counted, unless the window
+	// they were counted in is no longer the current one
+	RefundSlidingWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error
+}
+
+// SlidingLogRefunder is implemented by storages that can give back requests recorded by AllowSlidingLog
+type SlidingLogRefunder interface {
+	// RefundSlidingLog removes up to n entries recorded at counted that are still in the
+	// rolling window
+	RefundSlidingLog(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error
+}
+
+// GCRARefunder is implemented by storages that can give back requests allowed by AllowGCRA
+type GCRARefunder interface {
+	// RefundGCRA moves the key's theoretical arrival time back by n emission intervals,
+	// but not before now
+	RefundGCRA(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) error
+}
+
+// OffenseStorage is implemented by storages that count how often a key was
+// blocked, for escalating blocks of repeat offenders
+type OffenseStorage interface {
+	// AddOffense records an offense for a key, forgetting earlier offenses if the last one
+	// is older than decay, and returns the number of offenses counted
+	AddOffense(ctx context.Context, key string, now time.Time, decay time.Duration) (int, error)
+}
+
+// LegacyStorage is the original Storage interface, without context support and
+// without the time window, which legacy storages choose themselves
+//
+// Deprecated: implement Storage so deadlines, cancellation and the limiter's
+// time window reach the backend.
+type LegacyStorage interface {
+	IncrementRequests(key string, now time.Time) (int, error)
+	GetRequests(key string) (int, error)
+	IsBlocked(key string) (blocked bool, retryAfter time.Time, err error)
+	Block(key string, until time.Time) error
 	Reset(key string) error
 }
+
+// FromLegacy adapts a LegacyStorage to Storage, ignoring the context and the time window
+func FromLegacy(s LegacyStorage) Storage {
+	return legacyStorage{s}
+}
+
+type legacyStorage struct {
+	s LegacyStorage
+}
+
+func (l legacyStorage) IncrementRequests(_ context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	if n < 1 {
+		return l.s.GetRequests(key)
+	}
+
+	// Legacy storages only increment by one
+	var count int
+	for i := 0; i < n; i++ {
+		c, err := l.s.IncrementRequests(key, now)
+		if err != nil {
+			return 0, err
+		}
+		count = c
+	}
+	return count, nil
+}
+
+func (l legacyStorage) GetRequests(_ context.Context, key string) (int, error) {
+	return l.s.GetRequests(key)
+}
+
+func (l legacyStorage) IsBlocked(_ context.Context, key string) (bool, time.Time, error) {
+	return l.s.IsBlocked(key)
+}
+
+func (l legacyStorage) Block(_ context.Context, key string, until time.Time) error {
+	return l.s.Block(key, until)
+}
+
+func (l legacyStorage) Reset(_ context.Context, key string) error {
+	return l.s.Reset(key)
+}
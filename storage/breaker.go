@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+// ErrCircuitOpen is returned while the circuit is open and there is no fallback storage to serve the call
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed sends calls to the primary storage
+	BreakerClosed BreakerState = iota
+	// BreakerOpen sends calls to the fallback storage after the primary kept failing
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through to the primary storage
+	BreakerHalfOpen
+)
+
+// String returns the state name, for health checks and logs
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerOptions configures a CircuitBreaker
+type BreakerOptions struct {
+	FailureThreshold int           // Consecutive failures that open the circuit
+	LatencyThreshold time.Duration // Calls slower than this count as failures, disabled when zero
+	OpenDuration     time.Duration // Time the circuit stays open before probing the primary
+	CallTimeout      time.Duration // Deadline for each primary call, disabled when zero
+}
+
+// BreakerOption is a function that configures BreakerOptions
+type BreakerOption func(*BreakerOptions)
+
+// WithFailureThreshold sets how many consecutive failures open the circuit
+func WithFailureThreshold(n int) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.FailureThreshold = n
+	}
+}
+
+// WithLatencyThreshold counts calls slower than d as failures
+func WithLatencyThreshold(d time.Duration) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.LatencyThreshold = d
+	}
+}
+
+// WithOpenDuration sets how long the circuit stays open before probing the primary
+func WithOpenDuration(d time.Duration) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.OpenDuration = d
+	}
+}
+
+// WithCallTimeout sets a deadline for each primary call
+func WithCallTimeout(d time.Duration) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.CallTimeout = d
+	}
+}
+
+// CircuitBreaker is a Storage decorator that stops calling a failing primary
+// storage, such as a degraded Redis, and serves calls from a fallback storage
+// instead. It forwards the optional algorithm interfaces of both storages.
+type CircuitBreaker struct {
+	primary  ratelimiter.Storage
+	fallback ratelimiter.Storage
+	opts     BreakerOptions
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a circuit breaker around primary. Fallback serves
+// calls while the circuit is open and calls that just failed, and may be nil
+// to fail fast with ErrCircuitOpen instead.
+func NewCircuitBreaker(primary, fallback ratelimiter.Storage, opts ...BreakerOption) *CircuitBreaker {
+	options := BreakerOptions{
+		FailureThreshold: 5,                // Default: open after 5 consecutive failures
+		OpenDuration:     10 * time.Second, // Default: probe again after 10 seconds
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &CircuitBreaker{
+		primary:  primary,
+		fallback: fallback,
+		opts:     options,
+	}
+}
+
+// State returns the current state of the circuit
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.opts.OpenDuration {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// call runs fn against the primary storage when the circuit allows it, and
+// against the fallback storage otherwise or when the primary call fails
+func (b *CircuitBreaker) call(ctx context.Context, fn func(ctx context.Context, s ratelimiter.Storage) error) error {
+	probe, ok := b.acquire()
+	if !ok {
+		return b.callFallback(ctx, fn)
+	}
+
+	callCtx := ctx
+	if b.opts.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, b.opts.CallTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := fn(callCtx, b.primary)
+	elapsed := time.Since(start)
+
+	switch {
+	case err == nil:
+		b.record(probe, b.opts.LatencyThreshold > 0 && elapsed > b.opts.LatencyThreshold)
+		return nil
+	case errors.Is(err, ratelimiter.ErrAlgorithmNotSupported), ctx.Err() != nil:
+		// Neither unsupported algorithms nor callers giving up say anything about the storage
+		b.release(probe)
+		return err
+	}
+
+	b.record(probe, true)
+	if b.fallback == nil {
+		return err
+	}
+	return b.callFallback(ctx, fn)
+}
+
+// callFallback runs fn against the fallback storage
+func (b *CircuitBreaker) callFallback(ctx context.Context, fn func(ctx context.Context, s ratelimiter.Storage) error) error {
+	if b.fallback == nil {
+		return ErrCircuitOpen
+	}
+	return fn(ctx, b.fallback)
+}
+
+// acquire reports whether a call may go to the primary storage, and whether it is the half-open probe
+func (b *CircuitBreaker) acquire() (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return false, true
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.opts.OpenDuration {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+	}
+
+	// Only one probe at a time while half-open
+	if b.probing {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// record updates the circuit with the outcome of a primary call
+func (b *CircuitBreaker) record(probe bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.state, b.failures = BreakerClosed, 0
+		}
+		return
+	}
+
+	// Calls started before the circuit opened don't count
+	if b.state != BreakerClosed {
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.opts.FailureThreshold {
+		b.open()
+	}
+}
+
+// release ends a probe without an outcome
+func (b *CircuitBreaker) release(probe bool) {
+	if !probe {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// open trips the circuit, must be called with mu held
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+}
+
+// IncrementRequests increments the request count for a key by n
+func (b *CircuitBreaker) IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (count int, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		var err error
+		count, err = s.IncrementRequests(ctx, key, now, window, n)
+		return err
+	})
+	return count, err
+}
+
+// GetRequests returns the current request count for a key
+func (b *CircuitBreaker) GetRequests(ctx context.Context, key string) (count int, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		var err error
+		count, err = s.GetRequests(ctx, key)
+		return err
+	})
+	return count, err
+}
+
+// IsBlocked checks if a key is blocked
+func (b *CircuitBreaker) IsBlocked(ctx context.Context, key string) (blocked bool, retryAfter time.Time, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		var err error
+		blocked, retryAfter, err = s.IsBlocked(ctx, key)
+		return err
+	})
+	return blocked, retryAfter, err
+}
+
+// Block marks a key as blocked until the specified time
+func (b *CircuitBreaker) Block(ctx context.Context, key string, until time.Time) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		return s.Block(ctx, key, until)
+	})
+}
+
+// Reset resets all rate limit data for a key in both storages
+func (b *CircuitBreaker) Reset(ctx context.Context, key string) error {
+	err := b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		return s.Reset(ctx, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The fallback may hold state from the last time the circuit was open
+	if b.fallback != nil {
+		return b.fallback.Reset(ctx, key)
+	}
+	return nil
+}
+
+// AllowFixedWindow checks the block, counts a request of cost n and blocks the key once the count exceeds limit
+func (b *CircuitBreaker) AllowFixedWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (result ratelimiter.Result, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		var err error
+		result, err = allowFixedWindow(ctx, s, key, now, window, limit, blockDuration, n)
+		return err
+	})
+	return result, err
+}
+
+// AllowTokenBucket refills the bucket for a key and takes n tokens if available
+func (b *CircuitBreaker) AllowTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) (result ratelimiter.Result, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		ts, ok := s.(ratelimiter.TokenBucketStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		var err error
+		result, err = ts.AllowTokenBucket(ctx, key, now, rate, capacity, n)
+		return err
+	})
+	return result, err
+}
+
+// AllowSlidingWindow counts a request of cost n if the weighted count over the rolling window stays within the limit
+func (b *CircuitBreaker) AllowSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (result ratelimiter.Result, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		ss, ok := s.(ratelimiter.SlidingWindowStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		var err error
+		result, err = ss.AllowSlidingWindow(ctx, key, now, window, limit, n)
+		return err
+	})
+	return result, err
+}
+
+// AllowSlidingLog records a request of cost n if it fits within limit requests in the rolling window
+func (b *CircuitBreaker) AllowSlidingLog(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (result ratelimiter.Result, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		ls, ok := s.(ratelimiter.SlidingLogStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		var err error
+		result, err = ls.AllowSlidingLog(ctx, key, now, window, limit, n)
+		return err
+	})
+	return result, err
+}
+
+// AllowGCRA advances the key's theoretical arrival time by n emission intervals if the request conforms to the rate
+func (b *CircuitBreaker) AllowGCRA(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (result ratelimiter.Result, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		gs, ok := s.(ratelimiter.GCRAStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		var err error
+		result, err = gs.AllowGCRA(ctx, key, now, window, limit, n)
+		return err
+	})
+	return result, err
+}
+
+// AllowRules counts a request of cost n in every rule's window only if it fits within all of them
+func (b *CircuitBreaker) AllowRules(ctx context.Context, key string, now time.Time, rules []ratelimiter.Rule, n int) (allowed bool, states []ratelimiter.RuleState, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		rs, ok := s.(ratelimiter.RulesStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		var err error
+		allowed, states, err = rs.AllowRules(ctx, key, now, rules, n)
+		return err
+	})
+	return allowed, states, err
+}
+
+// ResetRules resets the windows of the given rules for a key
+func (b *CircuitBreaker) ResetRules(ctx context.Context, key string, rules []ratelimiter.Rule) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		rs, ok := s.(ratelimiter.RulesStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		return rs.ResetRules(ctx, key, rules)
+	})
+}
+
+// RefundFixedWindow uncounts n requests counted at counted, unless the key's window has reset since.
+// Storages that can't refund keep the requests.
+func (b *CircuitBreaker) RefundFixedWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		if rs, ok := s.(ratelimiter.FixedWindowRefunder); ok {
+			return rs.RefundFixedWindow(ctx, key, now, counted, window, n)
+		}
+		return nil
+	})
+}
+
+// RefundTokenBucket puts n tokens back in the key's bucket, up to capacity.
+// Storages that can't refund keep the tokens.
+func (b *CircuitBreaker) RefundTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		if rs, ok := s.(ratelimiter.TokenBucketRefunder); ok {
+			return rs.RefundTokenBucket(ctx, key, now, rate, capacity, n)
+		}
+		return nil
+	})
+}
+
+// RefundSlidingWindow uncounts n requests counted at counted, unless the window they were counted
+// in is no longer the current one. Storages that can't refund keep the requests.
+func (b *CircuitBreaker) RefundSlidingWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		if rs, ok := s.(ratelimiter.SlidingWindowRefunder); ok {
+			return rs.RefundSlidingWindow(ctx, key, now, counted, window, n)
+		}
+		return nil
+	})
+}
+
+// RefundSlidingLog removes up to n entries recorded at counted that are still in the rolling window.
+// Storages that can't refund keep the entries.
+func (b *CircuitBreaker) RefundSlidingLog(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		if rs, ok := s.(ratelimiter.SlidingLogRefunder); ok {
+			return rs.RefundSlidingLog(ctx, key, now, counted, window, n)
+		}
+		return nil
+	})
+}
+
+// RefundGCRA moves the key's theoretical arrival time back by n emission intervals, but not before now.
+// Storages that can't refund keep the arrival time.
+func (b *CircuitBreaker) RefundGCRA(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		if rs, ok := s.(ratelimiter.GCRARefunder); ok {
+			return rs.RefundGCRA(ctx, key, now, window, limit, n)
+		}
+		return nil
+	})
+}
+
+// RefundRules uncounts n requests counted at counted from every rule whose window hasn't reset since.
+// Storages that can't refund keep the requests.
+func (b *CircuitBreaker) RefundRules(ctx context.Context, key string, now, counted time.Time, rules []ratelimiter.Rule, n int) error {
+	return b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		if rs, ok := s.(ratelimiter.RulesRefunder); ok {
+			return rs.RefundRules(ctx, key, now, counted, rules, n)
+		}
+		return nil
+	})
+}
+
+// AddOffense records an offense for a key and returns the number of offenses within the decay period
+func (b *CircuitBreaker) AddOffense(ctx context.Context, key string, now time.Time, decay time.Duration) (count int, err error) {
+	err = b.call(ctx, func(ctx context.Context, s ratelimiter.Storage) error {
+		ofs, ok := s.(ratelimiter.OffenseStorage)
+		if !ok {
+			return ratelimiter.ErrAlgorithmNotSupported
+		}
+		var err error
+		count, err = ofs.AddOffense(ctx, key, now, decay)
+		return err
+	})
+	return count, err
+}
+
+// allowFixedWindow runs the fixed window check on s, through the separate
+// Storage calls when s can't take the decision atomically
+func allowFixedWindow(ctx context.Context, s ratelimiter.Storage, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (ratelimiter.Result, error) {
+	if fs, ok := s.(ratelimiter.FixedWindowStorage); ok {
+		return fs.AllowFixedWindow(ctx, key, now, window, limit, blockDuration, n)
+	}
+
+	blocked, until, err := s.IsBlocked(ctx, key)
+	if err != nil {
+		return ratelimiter.Result{}, err
+	}
+	if blocked {
+		return ratelimiter.Result{Allowed: false, RetryAfter: until, Count: limit, ResetAt: until}, nil
+	}
+
+	count, err := s.IncrementRequests(ctx, key, now, window, n)
+	if err != nil {
+		return ratelimiter.Result{}, err
+	}
+	if count <= limit {
+		return ratelimiter.Result{Allowed: true, Remaining: max(limit-count, 0), Count: count}, nil
+	}
+
+	until = now.Add(blockDuration)
+	if err := s.Block(ctx, key, until); err != nil {
+		return ratelimiter.Result{}, err
+	}
+	return ratelimiter.Result{Allowed: false, RetryAfter: until, Count: count, ResetAt: until}, nil
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+// flakyStorage is a MemoryStorage that fails or stalls on demand
+type flakyStorage struct {
+	*MemoryStorage
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (f *flakyStorage) IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	f.calls++
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.MemoryStorage.IncrementRequests(ctx, key, now, window, n)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	primary := &flakyStorage{MemoryStorage: NewMemoryStorage(), err: errors.New("connection refused")}
+	fallback := NewMemoryStorage()
+	breaker := NewCircuitBreaker(primary, fallback, WithFailureThreshold(3), WithOpenDuration(20*time.Millisecond))
+
+	// Failed calls are served by the fallback until the circuit opens
+	for i := 1; i <= 3; i++ {
+		count, err := breaker.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1)
+		if err != nil {
+			t.Fatalf("Expected fallback to serve the call, got %v", err)
+		}
+		if count != i {
+			t.Errorf("Expected fallback count %d, got %d", i, count)
+		}
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Expected circuit to be open, got %s", breaker.State())
+	}
+
+	// The primary isn't called while the circuit is open
+	if _, err := breaker.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if primary.calls != 3 {
+		t.Errorf("Expected 3 calls to the primary, got %d", primary.calls)
+	}
+
+	// A failed probe opens the circuit again
+	time.Sleep(25 * time.Millisecond)
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("Expected circuit to be half-open, got %s", breaker.State())
+	}
+	if _, err := breaker.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected failed probe to open the circuit, got %s", breaker.State())
+	}
+
+	// A successful probe closes it
+	time.Sleep(25 * time.Millisecond)
+	primary.err = nil
+	count, err := breaker.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected probe to reach the primary, got count %d", count)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected circuit to be closed, got %s", breaker.State())
+	}
+}
+
+func TestCircuitBreakerLatency(t *testing.T) {
+	ctx := context.Background()
+	primary := &flakyStorage{MemoryStorage: NewMemoryStorage(), delay: 5 * time.Millisecond}
+	breaker := NewCircuitBreaker(primary, nil, WithFailureThreshold(2), WithLatencyThreshold(time.Millisecond))
+
+	// Slow calls still succeed but open the circuit
+	for i := 0; i < 2; i++ {
+		if _, err := breaker.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1); err != nil {
+			t.Fatalf("Expected slow call to succeed, got %v", err)
+		}
+	}
+
+	// Without a fallback, calls fail fast while open
+	if _, err := breaker.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+}
+
+func TestCircuitBreakerAlgorithms(t *testing.T) {
+	breaker := NewCircuitBreaker(NewMemoryStorage(), NewMemoryStorage())
+	limiter := ratelimiter.New(breaker, ratelimiter.WithAlgorithm(ratelimiter.TokenBucket), ratelimiter.WithMaxRequests(1))
+
+	// The optional algorithm interfaces are forwarded
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !resp.Allowed {
+		t.Error("Expected first request to be allowed")
+	}
+
+	resp, err = limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed {
+		t.Error("Expected second request to be denied")
+	}
+}
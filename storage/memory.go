@@ -1,91 +1,960 @@
 package storage
 
 import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
 )
 
+// requestWindow is a fixed window. The mutex makes rolling the window over
+// and counting a request a single step, so concurrent callers at a window
+// boundary neither reset it twice nor count in a window being reset.
 type requestWindow struct {
-	count     int64
-	startTime atomic.Value // stores time.Time
+	mu    sync.Mutex
+	start time.Time
+	count int
+}
+
+// add counts n requests in the window containing now and returns the count
+// and when the window ends. A caller racing behind the latest window is
+// counted in it rather than resetting it.
+func (w *requestWindow) add(now time.Time, window time.Duration, n int) (int, time.Time) {
+	if w.start.IsZero() || now.Sub(w.start) >= window {
+		w.start, w.count = now, 0
+	}
+
+	w.count += n
+	return w.count, w.start.Add(window)
+}
+
+// refund uncounts n requests counted at counted if the window containing counted
+// is still the current one at now. Counts never go below zero.
+func (w *requestWindow) refund(now, counted time.Time, window time.Duration, n int) {
+	if counted.Before(w.start) || now.Sub(w.start) >= window {
+		return
+	}
+	w.count = max(w.count-n, 0)
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+type slidingWindow struct {
+	mu    sync.Mutex
+	start int64 // current window start in Unix nanoseconds
+	prev  int
+	curr  int
+}
+
+type requestLog struct {
+	mu    sync.Mutex
+	times []int64 // ring buffer of request times in Unix nanoseconds
+	head  int     // index of the oldest request
+	size  int
+}
+
+type offenseCount struct {
+	mu    sync.Mutex
+	count int
+	last  time.Time
+}
+
+type ruleWindow struct {
+	start time.Time
+	count int
+}
+
+type ruleWindows struct {
+	mu      sync.Mutex
+	windows map[ruleID]*ruleWindow
+}
+
+// ruleID identifies a rule's window independently of its position in the rule list
+type ruleID struct {
+	name   string
+	window time.Duration
+}
+
+// entry holds all rate limit state of a key, so the key can be removed at once
+type entry struct {
+	// mu is read locked while the state is in use and write locked to remove the entry
+	mu      sync.RWMutex
+	removed bool
+
+	lastUsed atomic.Int64 // Unix nanoseconds, for LRU eviction
+	hits     atomic.Int64 // for LFU eviction
+	expires  atomic.Int64 // Unix nanoseconds, when all state has gone stale
+
+	// State of each algorithm is allocated on first use, as keys are usually
+	// limited by a single one
+	requests atomic.Pointer[requestWindow]
+	block    atomic.Value // stores time.Time
+	bucket   atomic.Pointer[tokenBucket]
+	window   atomic.Pointer[slidingWindow]
+	log      atomic.Pointer[requestLog]
+	arrival  atomic.Int64 // theoretical arrival time for GCRA, in Unix nanoseconds
+	rules    atomic.Pointer[ruleWindows]
+	offense  atomic.Pointer[offenseCount]
+}
+
+// lazy returns the state p points to, allocating it if it wasn't used yet
+func lazy[T any](p *atomic.Pointer[T]) *T {
+	if state := p.Load(); state != nil {
+		return state
+	}
+	p.CompareAndSwap(nil, new(T))
+	return p.Load()
+}
+
+// size estimates the memory held by the entry and the state allocated for it
+func (e *entry) size() int64 {
+	size := int64(unsafe.Sizeof(*e))
+	if e.requests.Load() != nil {
+		size += int64(unsafe.Sizeof(requestWindow{}))
+	}
+	if e.bucket.Load() != nil {
+		size += int64(unsafe.Sizeof(tokenBucket{}))
+	}
+	if e.window.Load() != nil {
+		size += int64(unsafe.Sizeof(slidingWindow{}))
+	}
+	if e.offense.Load() != nil {
+		size += int64(unsafe.Sizeof(offenseCount{}))
+	}
+
+	if reqLog := e.log.Load(); reqLog != nil {
+		reqLog.mu.Lock()
+		size += int64(unsafe.Sizeof(*reqLog)) + int64(cap(reqLog.times))*8
+		reqLog.mu.Unlock()
+	}
+
+	if rw := e.rules.Load(); rw != nil {
+		rw.mu.Lock()
+		size += int64(unsafe.Sizeof(*rw)) + int64(len(rw.windows))*int64(unsafe.Sizeof(ruleID{})+unsafe.Sizeof(ruleWindow{}))
+		rw.mu.Unlock()
+	}
+	return size
 }
 
-type blockInfo struct {
-	until time.Time
+// keep extends the entry's lifetime until t
+func (e *entry) keep(t time.Time) {
+	until := t.UnixNano()
+	for {
+		expires := e.expires.Load()
+		if until <= expires || e.expires.CompareAndSwap(expires, until) {
+			return
+		}
+	}
+}
+
+// EvictionPolicy chooses the keys a MemoryStorage evicts once it holds MaxKeys keys
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used keys
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least frequently used keys
+	EvictLFU
+)
+
+// MemoryOptions configures a MemoryStorage
+type MemoryOptions struct {
+	MaxKeys         int            // Keys kept before evicting, unlimited when zero
+	Eviction        EvictionPolicy // Keys evicted first once MaxKeys is reached
+	CleanupInterval time.Duration  // Interval between removals of stale keys, disabled when zero
+}
+
+// MemoryOption is a function that configures MemoryOptions
+type MemoryOption func(*MemoryOptions)
+
+// WithMaxKeys caps the number of keys kept in memory. Expired keys are
+// evicted first, then a tenth of the keys chosen by the eviction policy.
+func WithMaxKeys(n int) MemoryOption {
+	return func(o *MemoryOptions) {
+		o.MaxKeys = n
+	}
+}
+
+// WithEviction sets which keys are evicted once MaxKeys is reached
+func WithEviction(p EvictionPolicy) MemoryOption {
+	return func(o *MemoryOptions) {
+		o.Eviction = p
+	}
+}
+
+// WithCleanupInterval sets how often stale keys are removed in the background.
+// The storage must be closed to stop the janitor.
+func WithCleanupInterval(d time.Duration) MemoryOption {
+	return func(o *MemoryOptions) {
+		o.CleanupInterval = d
+	}
+}
+
+// MemoryStats reports the keys held by a MemoryStorage
+type MemoryStats struct {
+	Keys        int   // Keys currently stored
+	Bytes       int64 // Estimated memory held by the stored state
+	Evictions   int64 // Keys evicted to stay within MaxKeys
+	Expirations int64 // Stale keys removed by the janitor
 }
 
 // MemoryStorage implements rate limiting storage in memory
 type MemoryStorage struct {
-	requests sync.Map
-	blocks   sync.Map
+	entries sync.Map // *entry by key
+	opts    MemoryOptions
+
+	keys        atomic.Int64
+	evictions   atomic.Int64
+	expirations atomic.Int64
+	evictMu     sync.Mutex
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewMemoryStorage creates a new memory-based storage
-func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{}
+// NewMemoryStorage creates a new memory-based storage. Stale keys are only
+// removed in the background with WithCleanupInterval, which starts a janitor
+// goroutine that runs until Close is called.
+func NewMemoryStorage(opts ...MemoryOption) *MemoryStorage {
+	options := MemoryOptions{
+		Eviction: EvictLRU, // Default: evict the least recently used keys
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	s := &MemoryStorage{
+		opts: options,
+		stop: make(chan struct{}),
+	}
+	if options.CleanupInterval > 0 {
+		go s.janitor(options.CleanupInterval)
+	}
+	return s
 }
 
-// IncrementRequests increments the request count for a key
-func (s *MemoryStorage) IncrementRequests(key string, now time.Time) (int, error) {
-	// Load or initialize window
-	value, loaded := s.requests.LoadOrStore(key, &requestWindow{
-		count: 0,
+// Close stops the janitor. The storage remains usable.
+func (s *MemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
 	})
-	window := value.(*requestWindow)
+	return nil
+}
 
-	// Initialize startTime if new window
-	if !loaded {
-		window.startTime.Store(now)
+// Stats returns the number of keys and an estimate of the memory they hold
+func (s *MemoryStorage) Stats() MemoryStats {
+	stats := MemoryStats{
+		Evictions:   s.evictions.Load(),
+		Expirations: s.expirations.Load(),
 	}
 
-	// Get current window start time
-	windowStart := window.startTime.Load().(time.Time)
+	s.entries.Range(func(k, value any) bool {
+		e := value.(*entry)
+		stats.Keys++
+		stats.Bytes += e.size() + int64(len(k.(string)))
+		return true
+	})
+	return stats
+}
+
+// janitor removes stale keys every interval until the storage is closed
+func (s *MemoryStorage) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	// Check if window needs reset
-	if now.Sub(windowStart) >= time.Minute {
-		// Try to reset window atomically
-		if atomic.CompareAndSwapInt64(&window.count, atomic.LoadInt64(&window.count), 0) {
-			window.startTime.Store(now)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.cleanup(now)
 		}
 	}
+}
 
-	// Increment and get count atomically
-	count := atomic.AddInt64(&window.count, 1)
-	return int(count), nil
+// cleanup removes the keys whose state has gone stale by now
+func (s *MemoryStorage) cleanup(now time.Time) {
+	s.entries.Range(func(k, value any) bool {
+		e := value.(*entry)
+		if e.expires.Load() < now.UnixNano() && s.remove(k.(string), e, now) {
+			s.expirations.Add(1)
+		}
+		return true
+	})
+}
+
+// acquire returns the read locked entry of a key, creating it if needed.
+// The caller must release it with e.mu.RUnlock.
+func (s *MemoryStorage) acquire(key string, now time.Time) *entry {
+	for {
+		value, ok := s.entries.Load(key)
+		if !ok {
+			e := &entry{}
+			e.lastUsed.Store(now.UnixNano())
+			if value, ok = s.entries.LoadOrStore(key, e); !ok {
+				if s.keys.Add(1) > int64(s.opts.MaxKeys) && s.opts.MaxKeys > 0 {
+					s.evict(now, e)
+				}
+			}
+		}
+
+		e := value.(*entry)
+		e.mu.RLock()
+		if !e.removed {
+			e.lastUsed.Store(now.UnixNano())
+			e.hits.Add(1)
+			return e
+		}
+		// Removed meanwhile, start over with a new entry
+		e.mu.RUnlock()
+	}
+}
+
+// lookup returns the read locked entry of a key, or nil if the key has no state.
+// The caller must release it with e.mu.RUnlock.
+func (s *MemoryStorage) lookup(key string) *entry {
+	for {
+		value, ok := s.entries.Load(key)
+		if !ok {
+			return nil
+		}
+
+		e := value.(*entry)
+		e.mu.RLock()
+		if !e.removed {
+			return e
+		}
+		e.mu.RUnlock()
+	}
+}
+
+// remove deletes the entry of a key. With a non-zero now, the entry is only
+// removed if it is still stale, as it may have been used since it was checked.
+func (s *MemoryStorage) remove(key string, e *entry, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.removed || (!now.IsZero() && e.expires.Load() >= now.UnixNano()) {
+		return false
+	}
+	e.removed = true
+	if s.entries.CompareAndDelete(key, e) {
+		s.keys.Add(-1)
+	}
+	return true
+}
+
+// evict brings the number of keys back under MaxKeys, removing stale keys
+// first and then a tenth of the keys chosen by the eviction policy, so the
+// keys aren't scanned again on every new key. The key just added is spared.
+func (s *MemoryStorage) evict(now time.Time, added *entry) {
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+
+	if s.keys.Load() <= int64(s.opts.MaxKeys) {
+		return
+	}
+
+	type candidate struct {
+		key      string
+		e        *entry
+		stale    bool
+		lastUsed int64
+		hits     int64
+	}
+
+	var candidates []candidate
+	s.entries.Range(func(k, value any) bool {
+		e := value.(*entry)
+		if e == added {
+			return true
+		}
+		candidates = append(candidates, candidate{
+			key:      k.(string),
+			e:        e,
+			stale:    e.expires.Load() < now.UnixNano(),
+			lastUsed: e.lastUsed.Load(),
+			hits:     e.hits.Load(),
+		})
+		return true
+	})
+
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.stale != b.stale:
+			if a.stale {
+				return -1
+			}
+			return 1
+		case s.opts.Eviction == EvictLFU && a.hits != b.hits:
+			return cmp.Compare(a.hits, b.hits)
+		default:
+			return cmp.Compare(a.lastUsed, b.lastUsed)
+		}
+	})
+
+	target := int64(s.opts.MaxKeys - s.opts.MaxKeys/10)
+	for _, c := range candidates {
+		if s.keys.Load() <= target {
+			return
+		}
+		if s.remove(c.key, c.e, time.Time{}) {
+			if c.stale {
+				s.expirations.Add(1)
+			} else {
+				s.evictions.Add(1)
+			}
+		}
+	}
+}
+
+// IncrementRequests increments the request count for a key by n
+func (s *MemoryStorage) IncrementRequests(_ context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	requests := lazy(&e.requests)
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+
+	count, resetAt := requests.add(now, window, n)
+	e.keep(resetAt)
+	return count, nil
 }
 
 // GetRequests returns the current request count for a key
-func (s *MemoryStorage) GetRequests(key string) (int, error) {
-	if value, ok := s.requests.Load(key); ok {
-		window := value.(*requestWindow)
-		return int(atomic.LoadInt64(&window.count)), nil
+func (s *MemoryStorage) GetRequests(_ context.Context, key string) (int, error) {
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		if requests := e.requests.Load(); requests != nil {
+			requests.mu.Lock()
+			defer requests.mu.Unlock()
+			return requests.count, nil
+		}
 	}
 	return 0, nil
 }
 
 // IsBlocked checks if a key is blocked
-func (s *MemoryStorage) IsBlocked(key string) (bool, time.Time, error) {
-	if value, ok := s.blocks.Load(key); ok {
-		block := value.(blockInfo)
-		if time.Now().Before(block.until) {
-			return true, block.until, nil
+func (s *MemoryStorage) IsBlocked(_ context.Context, key string) (bool, time.Time, error) {
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+		if until, _ := e.block.Load().(time.Time); time.Now().Before(until) {
+			return true, until, nil
 		}
-		// Block expired, clean up
-		s.blocks.Delete(key)
 	}
 	return false, time.Time{}, nil
 }
 
 // Block marks a key as blocked until the specified time
-func (s *MemoryStorage) Block(key string, until time.Time) error {
-	s.blocks.Store(key, blockInfo{until: until})
+func (s *MemoryStorage) Block(_ context.Context, key string, until time.Time) error {
+	e := s.acquire(key, time.Now())
+	defer e.mu.RUnlock()
+
+	e.block.Store(until)
+	e.keep(until)
 	return nil
 }
 
 // Reset resets all rate limit data for a key
-func (s *MemoryStorage) Reset(key string) error {
-	s.requests.Delete(key)
-	s.blocks.Delete(key)
+func (s *MemoryStorage) Reset(_ context.Context, key string) error {
+	if value, ok := s.entries.Load(key); ok {
+		s.remove(key, value.(*entry), time.Time{})
+	}
 	return nil
 }
+
+// AllowFixedWindow checks the block, counts a request of cost n and blocks the key once the count exceeds limit
+func (s *MemoryStorage) AllowFixedWindow(_ context.Context, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (ratelimiter.Result, error) {
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	// Checking the block, counting and blocking are a single step
+	requests := lazy(&e.requests)
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+
+	if until, _ := e.block.Load().(time.Time); now.Before(until) {
+		return ratelimiter.Result{
+			Allowed:    false,
+			RetryAfter: until,
+			Count:      limit,
+			ResetAt:    until,
+		}, nil
+	}
+
+	count, resetAt := requests.add(now, window, n)
+	e.keep(resetAt)
+
+	if count <= limit {
+		return ratelimiter.Result{
+			Allowed:   true,
+			Remaining: max(limit-count, 0),
+			Count:     count,
+			ResetAt:   resetAt,
+		}, nil
+	}
+
+	// Without a block duration the key is limited until the window resets
+	until := resetAt
+	if blockDuration > 0 {
+		until = now.Add(blockDuration)
+		e.block.Store(until)
+		e.keep(until)
+	}
+
+	return ratelimiter.Result{
+		Allowed:    false,
+		RetryAfter: until,
+		Count:      count,
+		ResetAt:    until,
+	}, nil
+}
+
+// RefundFixedWindow uncounts n requests counted at counted, unless the key's window has reset since
+func (s *MemoryStorage) RefundFixedWindow(_ context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		if requests := e.requests.Load(); requests != nil {
+			requests.mu.Lock()
+			defer requests.mu.Unlock()
+			requests.refund(now, counted, window, n)
+		}
+	}
+	return nil
+}
+
+// AllowTokenBucket refills the bucket for a key and takes n tokens if available
+func (s *MemoryStorage) AllowTokenBucket(_ context.Context, key string, now time.Time, rate float64, capacity int, n int) (ratelimiter.Result, error) {
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	bucket := lazy(&e.bucket)
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	// A new bucket starts full
+	if bucket.last.IsZero() {
+		bucket.tokens, bucket.last = float64(capacity), now
+	}
+
+	bucket.refill(now, rate, capacity)
+
+	if bucket.tokens >= float64(n) {
+		bucket.tokens -= float64(n)
+		e.keep(bucket.fullAt(now, rate, capacity))
+		return ratelimiter.Result{
+			Allowed:   true,
+			Remaining: int(bucket.tokens),
+			ResetAt:   bucket.fullAt(now, rate, capacity),
+		}, nil
+	}
+
+	// Wait until the missing tokens have been refilled
+	wait := time.Duration((float64(n) - bucket.tokens) / rate * float64(time.Second))
+	return ratelimiter.Result{
+		Allowed:    false,
+		RetryAfter: now.Add(wait),
+		ResetAt:    bucket.fullAt(now, rate, capacity),
+	}, nil
+}
+
+// RefundTokenBucket puts n tokens back in the key's bucket, up to capacity
+func (s *MemoryStorage) RefundTokenBucket(_ context.Context, key string, now time.Time, rate float64, capacity int, n int) error {
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		// A bucket that was never used is full already
+		bucket := e.bucket.Load()
+		if bucket == nil {
+			return nil
+		}
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+
+		if bucket.last.IsZero() {
+			return nil
+		}
+		bucket.refill(now, rate, capacity)
+		bucket.tokens = math.Min(float64(capacity), bucket.tokens+float64(n))
+	}
+	return nil
+}
+
+// refill adds the tokens refilled since the last update, up to capacity
+func (b *tokenBucket) refill(now time.Time, rate float64, capacity int) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(capacity), b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
+
+// fullAt returns when the bucket is refilled to capacity
+func (b *tokenBucket) fullAt(now time.Time, rate float64, capacity int) time.Time {
+	return now.Add(time.Duration((float64(capacity) - b.tokens) / rate * float64(time.Second)))
+}
+
+// AllowSlidingWindow counts a request of cost n if the weighted count over the rolling window stays within the limit
+func (s *MemoryStorage) AllowSlidingWindow(_ context.Context, key string, now time.Time, window time.Duration, limit int, n int) (ratelimiter.Result, error) {
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	sw := lazy(&e.window)
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	// Windows are aligned to the Unix epoch so every instance agrees on their boundaries
+	nowNs, windowNs := now.UnixNano(), int64(window)
+	start := nowNs - nowNs%windowNs
+
+	// Roll the counters over to the window containing now. A caller racing
+	// behind the latest window is counted in it rather than resetting it.
+	switch {
+	case start <= sw.start:
+		start = sw.start
+	case start == sw.start+windowNs:
+		sw.prev, sw.curr = sw.curr, 0
+	default:
+		sw.prev, sw.curr = 0, 0
+	}
+	sw.start = start
+
+	elapsed := max(nowNs-start, 0)
+	estimate := float64(sw.prev)*float64(windowNs-elapsed)/float64(windowNs) + float64(sw.curr)
+	if estimate+float64(n) <= float64(limit) {
+		sw.curr += n
+		e.keep(sw.resetAt(nowNs, windowNs))
+		return ratelimiter.Result{
+			Allowed:   true,
+			Remaining: int(float64(limit) - estimate - float64(n)),
+			ResetAt:   sw.resetAt(nowNs, windowNs),
+		}, nil
+	}
+
+	return ratelimiter.Result{
+		Allowed:    false,
+		RetryAfter: time.Unix(0, slidingWindowRetry(start, windowNs, sw.prev, sw.curr, limit, n)),
+		ResetAt:    sw.resetAt(nowNs, windowNs),
+	}, nil
+}
+
+// RefundSlidingWindow uncounts n requests counted at counted, unless the window they were
+// counted in is no longer the current one
+func (s *MemoryStorage) RefundSlidingWindow(_ context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		sw := e.window.Load()
+		if sw == nil {
+			return nil
+		}
+		sw.mu.Lock()
+		defer sw.mu.Unlock()
+
+		nowNs, countedNs, windowNs := now.UnixNano(), counted.UnixNano(), int64(window)
+		if start := countedNs - countedNs%windowNs; start == sw.start && nowNs-start < windowNs {
+			sw.curr = max(sw.curr-n, 0)
+		}
+	}
+	return nil
+}
+
+// resetAt returns when the weights of both counted windows have fully decayed
+func (sw *slidingWindow) resetAt(now, window int64) time.Time {
+	switch {
+	case sw.curr > 0:
+		return time.Unix(0, sw.start+2*window)
+	case sw.prev > 0:
+		return time.Unix(0, sw.start+window)
+	default:
+		return time.Unix(0, now)
+	}
+}
+
+// slidingWindowRetry returns when, in Unix nanoseconds, the weighted count leaves room for a request of cost n
+func slidingWindowRetry(start, window int64, prev, curr, limit, n int) int64 {
+	// The current window is full: wait until its weight, as the previous window, decays enough
+	if curr+n > limit {
+		if curr == 0 {
+			return start + window
+		}
+		wait := math.Ceil(float64(window) * (1 - float64(limit-n)/float64(curr)))
+		return start + window + max(int64(wait), 0)
+	}
+
+	// Otherwise wait until the previous window's weight decays enough
+	wait := math.Ceil(float64(window) * (1 - float64(limit-curr-n)/float64(prev)))
+	return start + int64(wait)
+}
+
+// AllowSlidingLog records a request of cost n if it fits within limit requests in the rolling window
+func (s *MemoryStorage) AllowSlidingLog(_ context.Context, key string, now time.Time, window time.Duration, limit int, n int) (ratelimiter.Result, error) {
+	if limit <= 0 || n > limit {
+		return ratelimiter.Result{Allowed: false, RetryAfter: now.Add(window), ResetAt: now.Add(window)}, nil
+	}
+
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	reqLog := lazy(&e.log)
+	reqLog.mu.Lock()
+	defer reqLog.mu.Unlock()
+
+	// Resize the ring buffer keeping the newest requests when the limit changes
+	if len(reqLog.times) != limit {
+		times := make([]int64, limit)
+		keep := min(reqLog.size, limit)
+		for i := 0; i < keep; i++ {
+			times[i] = reqLog.times[(reqLog.head+reqLog.size-keep+i)%len(reqLog.times)]
+		}
+		reqLog.times, reqLog.head, reqLog.size = times, 0, keep
+	}
+
+	// Prune requests that left the rolling window
+	cutoff := now.Add(-window).UnixNano()
+	for reqLog.size > 0 && reqLog.times[reqLog.head] <= cutoff {
+		reqLog.head = (reqLog.head + 1) % limit
+		reqLog.size--
+	}
+
+	if reqLog.size+n <= limit {
+		for i := 0; i < n; i++ {
+			reqLog.times[(reqLog.head+reqLog.size)%limit] = now.UnixNano()
+			reqLog.size++
+		}
+		e.keep(reqLog.resetAt(now, window))
+		return ratelimiter.Result{
+			Allowed:   true,
+			Remaining: limit - reqLog.size,
+			ResetAt:   reqLog.resetAt(now, window),
+		}, nil
+	}
+
+	// Enough of the oldest requests must leave the window to make room for n more
+	oldest := (reqLog.head + reqLog.size + n - limit - 1) % limit
+	return ratelimiter.Result{
+		Allowed:    false,
+		RetryAfter: time.Unix(0, reqLog.times[oldest]).Add(window),
+		ResetAt:    reqLog.resetAt(now, window),
+	}, nil
+}
+
+// RefundSlidingLog removes up to n entries recorded at counted that are still in the rolling window
+func (s *MemoryStorage) RefundSlidingLog(_ context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	if !counted.After(now.Add(-window)) {
+		return nil
+	}
+
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		reqLog := e.log.Load()
+		if reqLog == nil {
+			return nil
+		}
+		reqLog.mu.Lock()
+		defer reqLog.mu.Unlock()
+
+		// Entries of the refunded request are moved over by the newer ones
+		at, kept := counted.UnixNano(), 0
+		for i := 0; i < reqLog.size; i++ {
+			t := reqLog.times[(reqLog.head+i)%len(reqLog.times)]
+			if t == at && n > 0 {
+				n--
+				continue
+			}
+			reqLog.times[(reqLog.head+kept)%len(reqLog.times)] = t
+			kept++
+		}
+		reqLog.size = kept
+	}
+	return nil
+}
+
+// resetAt returns when the newest logged request leaves the rolling window
+func (l *requestLog) resetAt(now time.Time, window time.Duration) time.Time {
+	if l.size == 0 {
+		return now
+	}
+	newest := l.times[(l.head+l.size-1)%len(l.times)]
+	return time.Unix(0, newest).Add(window)
+}
+
+// AllowGCRA advances the key's theoretical arrival time by n emission intervals if the request conforms to the rate
+func (s *MemoryStorage) AllowGCRA(_ context.Context, key string, now time.Time, window time.Duration, limit int, n int) (ratelimiter.Result, error) {
+	if limit <= 0 {
+		return ratelimiter.Result{Allowed: false, RetryAfter: now.Add(window), ResetAt: now.Add(window)}, nil
+	}
+
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	arrival := &e.arrival
+
+	// Windows shorter than limit nanoseconds still allow at most one request per nanosecond
+	interval := max(int64(window)/int64(limit), 1)
+	nowNs := now.UnixNano()
+
+	for {
+		tat := arrival.Load()
+		newTat := max(tat, nowNs) + interval*int64(n)
+
+		// Requests arriving earlier than the burst tolerance allows don't conform
+		if allowAt := newTat - int64(window); nowNs < allowAt {
+			return ratelimiter.Result{
+				Allowed:    false,
+				RetryAfter: time.Unix(0, allowAt),
+				ResetAt:    time.Unix(0, max(tat, nowNs)),
+			}, nil
+		}
+
+		// The full burst is available again once the theoretical arrival time is reached
+		if arrival.CompareAndSwap(tat, newTat) {
+			e.keep(time.Unix(0, newTat))
+			return ratelimiter.Result{
+				Allowed:   true,
+				Remaining: int((int64(window) - (newTat - nowNs)) / interval),
+				ResetAt:   time.Unix(0, max(newTat, nowNs)),
+			}, nil
+		}
+	}
+}
+
+// RefundGCRA moves the key's theoretical arrival time back by n emission intervals, but not before now
+func (s *MemoryStorage) RefundGCRA(_ context.Context, key string, now time.Time, window time.Duration, limit int, n int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		interval := max(int64(window)/int64(limit), 1)
+		for {
+			tat := e.arrival.Load()
+			if e.arrival.CompareAndSwap(tat, max(tat-interval*int64(n), now.UnixNano())) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// AllowRules counts a request of cost n in every rule's window only if it fits within all of them
+func (s *MemoryStorage) AllowRules(_ context.Context, key string, now time.Time, rules []ratelimiter.Rule, n int) (bool, []ratelimiter.RuleState, error) {
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	rw := lazy(&e.rules)
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.windows == nil {
+		rw.windows = make(map[ruleID]*ruleWindow)
+	}
+
+	allowed := true
+	windows := make([]*ruleWindow, len(rules))
+	states := make([]ratelimiter.RuleState, len(rules))
+	for i, rule := range rules {
+		// Start a new window once the previous one has elapsed
+		w, ok := rw.windows[ruleID{rule.Name, rule.TimeWindow}]
+		if !ok || now.Sub(w.start) >= rule.TimeWindow {
+			w = &ruleWindow{start: now}
+		}
+
+		if w.count+n > rule.MaxRequests {
+			allowed = false
+		}
+		windows[i] = w
+		states[i] = ratelimiter.RuleState{Count: w.count, ResetAt: w.start.Add(rule.TimeWindow)}
+	}
+
+	if !allowed {
+		return false, states, nil
+	}
+
+	for i, rule := range rules {
+		windows[i].count += n
+		states[i].Count = windows[i].count
+		rw.windows[ruleID{rule.Name, rule.TimeWindow}] = windows[i]
+		e.keep(states[i].ResetAt)
+	}
+	return true, states, nil
+}
+
+// RefundRules uncounts n requests counted at counted from every rule whose window hasn't reset since
+func (s *MemoryStorage) RefundRules(_ context.Context, key string, now, counted time.Time, rules []ratelimiter.Rule, n int) error {
+	if e := s.lookup(key); e != nil {
+		defer e.mu.RUnlock()
+
+		rw := e.rules.Load()
+		if rw == nil {
+			return nil
+		}
+		rw.mu.Lock()
+		defer rw.mu.Unlock()
+
+		for _, rule := range rules {
+			w, ok := rw.windows[ruleID{rule.Name, rule.TimeWindow}]
+			if !ok || counted.Before(w.start) || now.Sub(w.start) >= rule.TimeWindow {
+				continue
+			}
+			w.count = max(w.count-n, 0)
+		}
+	}
+	return nil
+}
+
+// ResetRules resets the windows of the given rules for a key
+func (s *MemoryStorage) ResetRules(_ context.Context, key string, rules []ratelimiter.Rule) error {
+	e := s.lookup(key)
+	if e == nil {
+		return nil
+	}
+	defer e.mu.RUnlock()
+
+	rw := e.rules.Load()
+	if rw == nil {
+		return nil
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	for _, rule := range rules {
+		delete(rw.windows, ruleID{rule.Name, rule.TimeWindow})
+	}
+	return nil
+}
+
+// AddOffense records an offense for a key and returns the number of offenses within the decay period
+func (s *MemoryStorage) AddOffense(_ context.Context, key string, now time.Time, decay time.Duration) (int, error) {
+	e := s.acquire(key, now)
+	defer e.mu.RUnlock()
+
+	offense := lazy(&e.offense)
+	offense.mu.Lock()
+	defer offense.mu.Unlock()
+
+	// Offenses are forgotten once the key behaved for the whole decay period
+	if now.Sub(offense.last) >= decay {
+		offense.count = 0
+	}
+	offense.count++
+	offense.last = now
+	e.keep(now.Add(decay))
+	return offense.count, nil
+}
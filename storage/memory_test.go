@@ -1,15 +1,22 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
 )
 
 func TestMemoryStorage(t *testing.T) {
 	storage := NewMemoryStorage()
+	ctx := context.Background()
 
 	// Test increment requests
-	count, err := storage.IncrementRequests("test-ip", time.Now())
+	count, err := storage.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -18,7 +25,7 @@ func TestMemoryStorage(t *testing.T) {
 	}
 
 	// Test get requests
-	count, err = storage.GetRequests("test-ip")
+	count, err = storage.GetRequests(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -28,13 +35,13 @@ func TestMemoryStorage(t *testing.T) {
 
 	// Test block
 	blockUntil := time.Now().Add(time.Minute)
-	err = storage.Block("test-ip", blockUntil)
+	err = storage.Block(ctx, "test-ip", blockUntil)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
 	// Test is blocked
-	blocked, retryAfter, err := storage.IsBlocked("test-ip")
+	blocked, retryAfter, err := storage.IsBlocked(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -46,12 +53,12 @@ func TestMemoryStorage(t *testing.T) {
 	}
 
 	// Test reset
-	err = storage.Reset("test-ip")
+	err = storage.Reset(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	count, err = storage.GetRequests("test-ip")
+	count, err = storage.GetRequests(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -59,3 +66,907 @@ func TestMemoryStorage(t *testing.T) {
 		t.Errorf("Expected count 0 after reset, got %d", count)
 	}
 }
+
+func TestMemoryStorageTokenBucket(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Burst up to the bucket capacity
+	for i := 0; i < 3; i++ {
+		result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 3, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("Expected %d tokens left, got %d", 2-i, result.Remaining)
+		}
+	}
+
+	// Bucket is empty
+	result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be denied with an empty bucket")
+	}
+	if !result.RetryAfter.Equal(now.Add(time.Second)) {
+		t.Errorf("Expected retry after %v, got %v", now.Add(time.Second), result.RetryAfter)
+	}
+
+	// One token is refilled after a second
+	result, err = storage.AllowTokenBucket(ctx, "test-ip", now.Add(time.Second), 1, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after refill")
+	}
+}
+
+func TestMemoryStorageSlidingWindow(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	window := time.Minute
+	start := time.Now().Truncate(window)
+
+	// Fill the limit right before the window boundary
+	for i := 0; i < 10; i++ {
+		result, err := storage.AllowSlidingWindow(ctx, "test-ip", start.Add(window-time.Second), window, 10, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	// Crossing the boundary doesn't reset the limit
+	next := start.Add(window)
+	result, err := storage.AllowSlidingWindow(ctx, "test-ip", next, window, 10, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request right after the window boundary to be denied")
+	}
+	if !result.RetryAfter.Equal(next.Add(window / 10)) {
+		t.Errorf("Expected retry after %v, got %v", next.Add(window/10), result.RetryAfter)
+	}
+
+	// Halfway through the next window the previous one weighs half
+	for i := 0; i < 5; i++ {
+		result, err = storage.AllowSlidingWindow(ctx, "test-ip", next.Add(window/2), window, 10, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	result, err = storage.AllowSlidingWindow(ctx, "test-ip", next.Add(window/2), window, 10, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the weighted limit to be denied")
+	}
+}
+
+func TestMemoryStorageSlidingWindowSubMillisecond(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	window := 500 * time.Microsecond
+	now := time.Now().Truncate(window)
+
+	for i := 0; i < 2; i++ {
+		result, err := storage.AllowSlidingWindow(ctx, "test-ip", now, window, 2, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	result, err := storage.AllowSlidingWindow(ctx, "test-ip", now, window, 2, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the limit to be denied")
+	}
+	if !result.RetryAfter.After(now) {
+		t.Errorf("Expected retry after %v, got %v", now, result.RetryAfter)
+	}
+
+	// Both windows have decayed
+	result, err = storage.AllowSlidingWindow(ctx, "test-ip", now.Add(2*window), window, 2, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed two windows later")
+	}
+}
+
+func TestMemoryStorageSlidingLog(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	window := 10 * time.Second
+	start := time.Now()
+
+	// Record one request per second up to the limit
+	for i := 0; i < 3; i++ {
+		result, err := storage.AllowSlidingLog(ctx, "test-ip", start.Add(time.Duration(i)*time.Second), window, 3, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("Expected %d requests left, got %d", 2-i, result.Remaining)
+		}
+	}
+
+	// The log is full until the oldest request leaves the window
+	result, err := storage.AllowSlidingLog(ctx, "test-ip", start.Add(3*time.Second), window, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be denied with a full log")
+	}
+	if !result.RetryAfter.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Expected retry after %v, got %v", start.Add(10*time.Second), result.RetryAfter)
+	}
+
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", start.Add(window), window, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed once the oldest request left the window")
+	}
+	if result.Remaining != 0 {
+		t.Errorf("Expected 0 requests left, got %d", result.Remaining)
+	}
+}
+
+func TestMemoryStorageGCRA(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	window := 10 * time.Second
+	start := time.Now().Truncate(time.Millisecond)
+
+	// Burst up to the limit
+	for i := 0; i < 5; i++ {
+		result, err := storage.AllowGCRA(ctx, "test-ip", start, window, 5, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != 4-i {
+			t.Errorf("Expected %d requests left, got %d", 4-i, result.Remaining)
+		}
+	}
+
+	// The next request conforms one emission interval later
+	result, err := storage.AllowGCRA(ctx, "test-ip", start, window, 5, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the burst to be denied")
+	}
+	if !result.RetryAfter.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("Expected retry after %v, got %v", start.Add(2*time.Second), result.RetryAfter)
+	}
+
+	result, err = storage.AllowGCRA(ctx, "test-ip", start.Add(2*time.Second), window, 5, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after one emission interval")
+	}
+}
+
+func TestMemoryStorageGCRAShortWindow(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	// A window shorter than the limit in nanoseconds allows one request per nanosecond
+	window := 100 * time.Nanosecond
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		result, err := storage.AllowGCRA(ctx, "test-ip", now, window, 1000, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	result, err := storage.AllowGCRA(ctx, "test-ip", now, window, 1000, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the burst to be denied")
+	}
+
+	if err := storage.RefundGCRA(ctx, "test-ip", now, window, 1000, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err = storage.AllowGCRA(ctx, "test-ip", now, window, 1000, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected refunded request to be allowed")
+	}
+}
+
+func TestMemoryStorageTimeWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+	}{
+		{"per second", time.Second},
+		{"hourly", time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			ctx := context.Background()
+			start := time.Now()
+
+			// Requests within the window are counted together
+			for i, offset := range []time.Duration{0, tt.window / 2, tt.window - time.Millisecond} {
+				count, err := storage.IncrementRequests(ctx, "test-ip", start.Add(offset), tt.window, 1)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if count != i+1 {
+					t.Errorf("Expected count %d, got %d", i+1, count)
+				}
+			}
+
+			// The count resets once the window has elapsed
+			count, err := storage.IncrementRequests(ctx, "test-ip", start.Add(tt.window), tt.window, 1)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if count != 1 {
+				t.Errorf("Expected count 1 in the next window, got %d", count)
+			}
+		})
+	}
+}
+
+func TestMemoryStorageWeightedRequests(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Fixed windows count the full cost
+	for _, tc := range []struct{ n, want int }{{5, 5}, {3, 8}} {
+		count, err := storage.IncrementRequests(ctx, "test-ip", now, time.Minute, tc.n)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if count != tc.want {
+			t.Errorf("Expected count %d, got %d", tc.want, count)
+		}
+	}
+
+	// A request only fits if its whole cost fits
+	result, err := storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 5, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("Expected request of cost 3 to be allowed with 2 left, got %+v", result)
+	}
+
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 5, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request of cost 3 to be denied with 2 left")
+	}
+
+	result, err = storage.AllowTokenBucket(ctx, "test-ip", now, 1, 10, 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected request of cost 10 to empty the bucket, got %+v", result)
+	}
+}
+
+func TestMemoryStorageRules(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	rules := []ratelimiter.Rule{
+		{Name: "second", MaxRequests: 2, TimeWindow: time.Second},
+		{Name: "minute", MaxRequests: 3, TimeWindow: time.Minute},
+	}
+	now := time.Now()
+
+	// The per-second rule allows two requests
+	for i := 1; i <= 2; i++ {
+		allowed, states, err := storage.AllowRules(ctx, "test-ip", now, rules, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		if states[0].Count != i || states[1].Count != i {
+			t.Errorf("Expected both rules to count %d, got %+v", i, states)
+		}
+	}
+
+	// A denied request isn't counted by any rule
+	allowed, states, err := storage.AllowRules(ctx, "test-ip", now, rules, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed {
+		t.Error("Expected request over the per-second rule to be denied")
+	}
+	if states[1].Count != 2 {
+		t.Errorf("Expected the per-minute rule to still count 2, got %d", states[1].Count)
+	}
+
+	// Once the per-second rule is reset, the per-minute rule trips
+	if err := storage.ResetRules(ctx, "test-ip", rules[:1]); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	allowed, _, err = storage.AllowRules(ctx, "test-ip", now, rules, 1)
+	if err != nil || !allowed {
+		t.Fatalf("Expected request to be allowed after the per-second reset, got %v (%v)", allowed, err)
+	}
+	allowed, states, err = storage.AllowRules(ctx, "test-ip", now, rules, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed {
+		t.Error("Expected request over the per-minute rule to be denied")
+	}
+	if states[1].Count != 3 {
+		t.Errorf("Expected the per-minute rule to count 3, got %d", states[1].Count)
+	}
+	if states[1].ResetAt.Before(now.Add(59*time.Second)) || states[1].ResetAt.After(now.Add(time.Minute)) {
+		t.Errorf("Expected the per-minute rule to reset in a minute, got %v", states[1].ResetAt)
+	}
+}
+
+func TestMemoryStorageRefund(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Fixed window counts never go below zero
+	if _, err := storage.IncrementRequests(ctx, "test-ip", now, time.Minute, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, want := range []int{1, 0, 0} {
+		if err := storage.RefundFixedWindow(ctx, "test-ip", now, now, time.Minute, 1); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if count, _ := storage.GetRequests(ctx, "test-ip"); count != want {
+			t.Errorf("Expected count %d after refund, got %d", want, count)
+		}
+	}
+
+	// Requests counted in an earlier window aren't refunded from the current one
+	first := time.Now()
+	if _, err := storage.IncrementRequests(ctx, "rolled", first, 50*time.Millisecond, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	later := time.Now()
+	if _, err := storage.IncrementRequests(ctx, "rolled", later, 50*time.Millisecond, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundFixedWindow(ctx, "rolled", later, first, 50*time.Millisecond, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "rolled"); count != 1 {
+		t.Errorf("Expected refund from an earlier window to be skipped, got count %d", count)
+	}
+
+	// Refunds through the atomic fixed window leave the block in place
+	for i := 0; i < 2; i++ {
+		if _, err := storage.AllowFixedWindow(ctx, "atomic", now, time.Minute, 1, time.Minute, 1); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if err := storage.RefundFixedWindow(ctx, "atomic", now, now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "atomic"); count != 1 {
+		t.Errorf("Expected count 1 after refund, got %d", count)
+	}
+
+	// A refunded token can be taken again, and refunds don't overflow the bucket
+	if _, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 1, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundTokenBucket(ctx, "test-ip", now, 1, 1, 5); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 1, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected the single refunded token to be available, got %+v", result)
+	}
+
+	// Sliding window refunds only apply to the window they were counted in
+	if _, err := storage.AllowSlidingWindow(ctx, "test-ip", now, time.Minute, 2, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundSlidingWindow(ctx, "test-ip", now.Add(time.Minute), now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result, _ := storage.AllowSlidingWindow(ctx, "test-ip", now, time.Minute, 2, 1); result.Allowed {
+		t.Error("Expected refund from an earlier window to be skipped")
+	}
+	if err := storage.RefundSlidingWindow(ctx, "test-ip", now, now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result, _ := storage.AllowSlidingWindow(ctx, "test-ip", now, time.Minute, 2, 1); !result.Allowed {
+		t.Error("Expected refunded request to be allowed")
+	}
+
+	// Refunds drop the entries of the refunded request
+	if _, err := storage.AllowSlidingLog(ctx, "test-ip", now.Add(-time.Second), time.Minute, 3, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 3, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundSlidingLog(ctx, "test-ip", now, now, time.Minute, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 3, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected the refunded entries to be available, got %+v", result)
+	}
+
+	// Refunds move the arrival time back
+	if _, err := storage.AllowGCRA(ctx, "test-ip", now, time.Minute, 1, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundGCRA(ctx, "test-ip", now, time.Minute, 1, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err = storage.AllowGCRA(ctx, "test-ip", now, time.Minute, 1, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected refunded request to be allowed")
+	}
+
+	// Rule refunds skip rules whose window reset
+	rules := []ratelimiter.Rule{
+		{Name: "burst", MaxRequests: 1, TimeWindow: 50 * time.Millisecond},
+		{Name: "minute", MaxRequests: 2, TimeWindow: time.Minute},
+	}
+	first = time.Now()
+	if _, _, err := storage.AllowRules(ctx, "test-ip", first, rules, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	later = time.Now()
+	if _, _, err := storage.AllowRules(ctx, "test-ip", later, rules, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundRules(ctx, "test-ip", later, first, rules, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	allowed, states, err := storage.AllowRules(ctx, "test-ip", later, rules, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed || states[1].Count != 1 {
+		t.Errorf("Expected only the per-minute rule to be refunded, got allowed %v and %+v", allowed, states)
+	}
+}
+
+func TestMemoryStorageFixedWindow(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Requests up to the limit are allowed until the window resets
+	for i := 1; i <= 2; i++ {
+		result, err := storage.AllowFixedWindow(ctx, "test-ip", now, time.Minute, 2, time.Minute, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		if result.Count != i || result.Remaining != 2-i {
+			t.Errorf("Expected count %d and %d left, got %+v", i, 2-i, result)
+		}
+		if !result.ResetAt.Equal(now.Add(time.Minute)) {
+			t.Errorf("Expected window to reset at %v, got %v", now.Add(time.Minute), result.ResetAt)
+		}
+	}
+
+	// Exceeding the limit blocks the key
+	later := now.Add(time.Second)
+	result, err := storage.AllowFixedWindow(ctx, "test-ip", later, time.Minute, 2, time.Minute, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the limit to be denied")
+	}
+	if !result.RetryAfter.Equal(later.Add(time.Minute)) || !result.ResetAt.Equal(result.RetryAfter) {
+		t.Errorf("Expected retry and reset at %v, got %+v", later.Add(time.Minute), result)
+	}
+
+	// The block is visible through IsBlocked
+	blocked, _, err := storage.IsBlocked(ctx, "test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !blocked {
+		t.Error("Expected key to be blocked")
+	}
+}
+
+func TestMemoryStorageResetAt(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	// An emptied bucket is full again after refilling at 1 token per second
+	result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 2, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.ResetAt.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("Expected bucket to be full at %v, got %v", now.Add(2*time.Second), result.ResetAt)
+	}
+
+	// The log resets once its newest request leaves the window
+	storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 2, 1)
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", now.Add(time.Second), time.Minute, 2, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.ResetAt.Equal(now.Add(time.Second + time.Minute)) {
+		t.Errorf("Expected log to reset at %v, got %v", now.Add(time.Second+time.Minute), result.ResetAt)
+	}
+
+	// The full burst is available again at the theoretical arrival time
+	result, err = storage.AllowGCRA(ctx, "test-ip", now, time.Minute, 2, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.ResetAt.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Expected arrival time %v, got %v", now.Add(30*time.Second), result.ResetAt)
+	}
+}
+
+func TestMemoryStorageEscalation(t *testing.T) {
+	storage := NewMemoryStorage()
+	limiter := ratelimiter.New(storage, ratelimiter.WithMaxRequests(1), ratelimiter.WithEscalation(ratelimiter.Escalation{
+		Durations: []time.Duration{10 * time.Millisecond, time.Hour},
+	}))
+
+	// The first offense gets the first block
+	limiter.Allow("test-ip")
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed || resp.Offenses != 1 {
+		t.Fatalf("Expected first offense, got %+v", resp)
+	}
+
+	// Offending again once the block expires escalates it
+	time.Sleep(15 * time.Millisecond)
+	resp, err = limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed || resp.Offenses != 2 {
+		t.Fatalf("Expected second offense, got %+v", resp)
+	}
+	if time.Until(resp.RetryAfter) < 59*time.Minute {
+		t.Errorf("Expected an hour long block, got %v", time.Until(resp.RetryAfter))
+	}
+
+	blocked, retryAfter, err := storage.IsBlocked(context.Background(), "test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !blocked || !retryAfter.Equal(resp.RetryAfter) {
+		t.Errorf("Expected key to be blocked until %v, got %v (blocked: %v)", resp.RetryAfter, retryAfter, blocked)
+	}
+}
+
+func TestMemoryStorageOffenseDecay(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	for i, at := range []time.Time{now, now.Add(time.Minute), now.Add(2*time.Hour + time.Minute)} {
+		want := []int{1, 2, 1}[i]
+		count, err := storage.AddOffense(ctx, "test-ip", at, time.Hour)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if count != want {
+			t.Errorf("Expected %d offenses, got %d", want, count)
+		}
+	}
+}
+
+func TestMemoryStorageMaxKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  EvictionPolicy
+		evicted []string
+	}{
+		{"lru", EvictLRU, []string{"key-1", "key-2"}},
+		{"lfu", EvictLFU, []string{"key-2", "key-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewMemoryStorage(WithMaxKeys(10), WithEviction(tt.policy))
+			defer storage.Close()
+			ctx := context.Background()
+			now := time.Now()
+
+			for i := 0; i < 10; i++ {
+				storage.IncrementRequests(ctx, fmt.Sprintf("key-%d", i), now.Add(time.Duration(i)*time.Millisecond), time.Minute, 1)
+			}
+			// key-0 is the oldest but used again, key-1 is used more often than the rest
+			storage.IncrementRequests(ctx, "key-0", now.Add(10*time.Millisecond), time.Minute, 1)
+			storage.IncrementRequests(ctx, "key-1", now.Add(-time.Millisecond), time.Minute, 1)
+			storage.IncrementRequests(ctx, "key-1", now.Add(-time.Millisecond), time.Minute, 1)
+
+			// Going over the cap evicts a tenth of the keys, plus the one over
+			storage.IncrementRequests(ctx, "key-10", now.Add(11*time.Millisecond), time.Minute, 1)
+
+			stats := storage.Stats()
+			if stats.Keys != 9 || stats.Evictions != 2 {
+				t.Errorf("Expected 9 keys after 2 evictions, got %+v", stats)
+			}
+			for _, key := range tt.evicted {
+				if count, _ := storage.GetRequests(ctx, key); count != 0 {
+					t.Errorf("Expected %s to be evicted, got count %d", key, count)
+				}
+			}
+			if count, _ := storage.GetRequests(ctx, "key-10"); count != 1 {
+				t.Errorf("Expected the new key to be kept, got count %d", count)
+			}
+		})
+	}
+}
+
+func TestMemoryStorageMaxKeysStale(t *testing.T) {
+	storage := NewMemoryStorage(WithMaxKeys(2))
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Stale keys are evicted before recently used ones
+	storage.IncrementRequests(ctx, "active", now, time.Hour, 1)
+	storage.IncrementRequests(ctx, "stale", now.Add(-time.Hour), time.Second, 1)
+	storage.IncrementRequests(ctx, "new", now, time.Hour, 1)
+
+	if count, _ := storage.GetRequests(ctx, "stale"); count != 0 {
+		t.Errorf("Expected stale key to be evicted, got count %d", count)
+	}
+	if count, _ := storage.GetRequests(ctx, "active"); count != 1 {
+		t.Errorf("Expected active key to be kept, got count %d", count)
+	}
+	if stats := storage.Stats(); stats.Expirations != 1 || stats.Evictions != 0 {
+		t.Errorf("Expected 1 expiration and no evictions, got %+v", stats)
+	}
+}
+
+func TestMemoryStorageJanitor(t *testing.T) {
+	storage := NewMemoryStorage(WithCleanupInterval(10 * time.Millisecond))
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	storage.IncrementRequests(ctx, "expiring", now, 20*time.Millisecond, 1)
+	storage.Block(ctx, "blocked", now.Add(time.Hour))
+	storage.AllowTokenBucket(ctx, "bucket", now, 1000, 10, 1)
+
+	time.Sleep(50 * time.Millisecond)
+
+	stats := storage.Stats()
+	if stats.Keys != 1 || stats.Expirations != 2 {
+		t.Errorf("Expected only the blocked key to remain, got %+v", stats)
+	}
+	if blocked, _, _ := storage.IsBlocked(ctx, "blocked"); !blocked {
+		t.Error("Expected block to be kept until it expires")
+	}
+
+	// Closing stops the janitor but the storage remains usable
+	storage.Close()
+	storage.Close()
+	storage.IncrementRequests(ctx, "expiring", time.Now(), 20*time.Millisecond, 1)
+	time.Sleep(50 * time.Millisecond)
+	if count, _ := storage.GetRequests(ctx, "expiring"); count != 1 {
+		t.Errorf("Expected key to be kept once closed, got count %d", count)
+	}
+}
+
+func TestMemoryStorageStats(t *testing.T) {
+	storage := NewMemoryStorage()
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	storage.IncrementRequests(ctx, "fixed", now, time.Minute, 1)
+	small := storage.Stats()
+
+	storage.AllowSlidingLog(ctx, "log", now, time.Minute, 1000, 1)
+	stats := storage.Stats()
+
+	if small.Keys != 1 || stats.Keys != 2 {
+		t.Errorf("Expected 1 then 2 keys, got %d and %d", small.Keys, stats.Keys)
+	}
+	if stats.Bytes < small.Bytes+1000*8 {
+		t.Errorf("Expected the sliding log buffer to be counted, got %d bytes then %d", small.Bytes, stats.Bytes)
+	}
+
+	storage.Reset(ctx, "log")
+	if stats := storage.Stats(); stats.Keys != 1 || stats.Bytes != small.Bytes {
+		t.Errorf("Expected reset key to be removed, got %+v", stats)
+	}
+}
+
+func TestMemoryStorageLazyState(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+
+	storage.IncrementRequests(ctx, "fixed", now, time.Minute, 1)
+	storage.AllowTokenBucket(ctx, "bucket", now, 1, 10, 1)
+
+	// Only the state of the algorithm in use is allocated
+	value, _ := storage.entries.Load("fixed")
+	e := value.(*entry)
+	if e.requests.Load() == nil {
+		t.Error("Expected fixed window state to be allocated")
+	}
+	if e.bucket.Load() != nil || e.window.Load() != nil || e.log.Load() != nil || e.rules.Load() != nil || e.offense.Load() != nil {
+		t.Error("Expected no state of other algorithms to be allocated")
+	}
+
+	// Refunds and reads don't allocate state either
+	storage.RefundSlidingWindow(ctx, "bucket", now, now, time.Minute, 1)
+	storage.ResetRules(ctx, "bucket", []ratelimiter.Rule{{Name: "minute", MaxRequests: 10, TimeWindow: time.Minute}})
+	if count, _ := storage.GetRequests(ctx, "bucket"); count != 0 {
+		t.Errorf("Expected no requests counted, got %d", count)
+	}
+	value, _ = storage.entries.Load("bucket")
+	e = value.(*entry)
+	if e.bucket.Load() == nil || e.requests.Load() != nil || e.window.Load() != nil || e.rules.Load() != nil {
+		t.Error("Expected only token bucket state to be allocated")
+	}
+}
+
+func TestMemoryStorageFixedWindowRollover(t *testing.T) {
+	const goroutines, requests = 32, 100
+
+	storage := NewMemoryStorage()
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	// run calls fn concurrently from every goroutine, starting them at once
+	run := func(fn func(g int)) {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				<-start
+				fn(g)
+			}(g)
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	for round := 0; round < 10; round++ {
+		key := fmt.Sprintf("test-ip-%d", round)
+
+		// Fill the first window, with callers straddling its end
+		run(func(g int) {
+			for i := 0; i < requests; i++ {
+				storage.IncrementRequests(ctx, key, now.Add(time.Duration(i%2)*time.Millisecond), time.Second, 1)
+			}
+		})
+		if count, _ := storage.GetRequests(ctx, key); count != goroutines*requests {
+			t.Fatalf("Expected %d requests in the first window, got %d", goroutines*requests, count)
+		}
+
+		// Every caller after the boundary lands in a single new window
+		counts := make([]int, goroutines)
+		run(func(g int) {
+			counts[g], _ = storage.IncrementRequests(ctx, key, now.Add(time.Second+time.Duration(g)*time.Microsecond), time.Second, 1)
+		})
+		sort.Ints(counts)
+		for i, count := range counts {
+			if count != i+1 {
+				t.Fatalf("Expected counts 1 to %d in the new window, got %v", goroutines, counts)
+			}
+		}
+	}
+}
+
+func TestMemoryStorageFixedWindowConcurrentLimit(t *testing.T) {
+	const goroutines, limit = 64, 10
+
+	storage := NewMemoryStorage()
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Exhaust the first window, then race into the next one
+	for i := 0; i < limit; i++ {
+		storage.AllowFixedWindow(ctx, "test-ip", now, time.Second, limit, 0, 1)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			result, err := storage.AllowFixedWindow(ctx, "test-ip", now.Add(time.Second), time.Second, limit, 0, 1)
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if result.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if allowed != limit {
+		t.Errorf("Expected exactly %d requests allowed in the new window, got %d", limit, allowed)
+	}
+}
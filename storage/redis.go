@@ -3,9 +3,11 @@ package storage
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"strconv"
 	"time"
 
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -14,15 +16,19 @@ type RedisStorage struct {
 	client redisClient
 }
 
-// redisClient interface defines the Redis operations we need
+// redisClient interface defines the Redis operations we need. It is
+// implemented by redis.UniversalClient: single node, Sentinel and Cluster clients.
 type redisClient interface {
 	Get(ctx context.Context, key string) *redis.StringCmd
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	Incr(ctx context.Context, key string) *redis.IntCmd
+	IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
-	ExpireAt(ctx context.Context, key string, tm time.Time) *redis.BoolCmd
+	PExpireAt(ctx context.Context, key string, tm time.Time) *redis.BoolCmd
+	redis.Scripter
 }
 
+var _ redisClient = redis.UniversalClient(nil)
+
 // NewRedisStorage creates a new Redis-based storage
 func NewRedisStorage(client redisClient) *RedisStorage {
 	return &RedisStorage{
@@ -30,20 +36,19 @@ func NewRedisStorage(client redisClient) *RedisStorage {
 	}
 }
 
-// IncrementRequests increments the request count for a key
-func (s *RedisStorage) IncrementRequests(key string, now time.Time) (int, error) {
-	ctx := context.Background()
-	windowKey := fmt.Sprintf("ratelimit:req:%s", key)
+// IncrementRequests increments the request count for a key by n
+func (s *RedisStorage) IncrementRequests(ctx context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	windowKey := redisKey("req", key)
 	
 	// Increment the counter
-	count := s.client.Incr(ctx, windowKey)
+	count := s.client.IncrBy(ctx, windowKey, int64(n))
 	if err := count.Err(); err != nil {
 		return 0, fmt.Errorf("failed to increment requests: %w", err)
 	}
 
 	// Set expiration if this is the first request in the window
-	if count.Val() == 1 {
-		expireCmd := s.client.ExpireAt(ctx, windowKey, now.Add(time.Minute))
+	if count.Val() == int64(n) {
+		expireCmd := s.client.PExpireAt(ctx, windowKey, now.Add(window))
 		if err := expireCmd.Err(); err != nil {
 			return 0, fmt.Errorf("failed to set expiration: %w", err)
 		}
@@ -53,9 +58,8 @@ func (s *RedisStorage) IncrementRequests(key string, now time.Time) (int, error)
 }
 
 // GetRequests returns the current request count for a key
-func (s *RedisStorage) GetRequests(key string) (int, error) {
-	ctx := context.Background()
-	windowKey := fmt.Sprintf("ratelimit:req:%s", key)
+func (s *RedisStorage) GetRequests(ctx context.Context, key string) (int, error) {
+	windowKey := redisKey("req", key)
 	
 	val := s.client.Get(ctx, windowKey)
 	if err := val.Err(); err != nil {
@@ -75,9 +79,8 @@ func (s *RedisStorage) GetRequests(key string) (int, error) {
 }
 
 // IsBlocked checks if a key is blocked
-func (s *RedisStorage) IsBlocked(key string) (bool, time.Time, error) {
-	ctx := context.Background()
-	blockKey := fmt.Sprintf("ratelimit:block:%s", key)
+func (s *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, time.Time, error) {
+	blockKey := redisKey("block", key)
 	
 	val := s.client.Get(ctx, blockKey)
 	if err := val.Err(); err != nil {
@@ -94,7 +97,7 @@ func (s *RedisStorage) IsBlocked(key string) (bool, time.Time, error) {
 		return false, time.Time{}, fmt.Errorf("failed to parse block time: %w", err)
 	}
 
-	retryAfter := time.Unix(unixTime, 0)
+	retryAfter := time.UnixMilli(unixTime)
 	
 	// Check if still blocked
 	if time.Now().Before(retryAfter) {
@@ -107,12 +110,11 @@ func (s *RedisStorage) IsBlocked(key string) (bool, time.Time, error) {
 }
 
 // Block marks a key as blocked until the specified time
-func (s *RedisStorage) Block(key string, until time.Time) error {
-	ctx := context.Background()
-	blockKey := fmt.Sprintf("ratelimit:block:%s", key)
+func (s *RedisStorage) Block(ctx context.Context, key string, until time.Time) error {
+	blockKey := redisKey("block", key)
 	
-	// Store the block expiration time
-	cmd := s.client.Set(ctx, blockKey, until.Unix(), time.Until(until))
+	// Store the block expiration time in Unix milliseconds
+	cmd := s.client.Set(ctx, blockKey, until.UnixMilli(), time.Until(until))
 	if err := cmd.Err(); err != nil {
 		return fmt.Errorf("failed to set block: %w", err)
 	}
@@ -121,15 +123,278 @@ func (s *RedisStorage) Block(key string, until time.Time) error {
 }
 
 // Reset resets all rate limit data for a key
-func (s *RedisStorage) Reset(key string) error {
-	ctx := context.Background()
-	windowKey := fmt.Sprintf("ratelimit:req:%s", key)
-	blockKey := fmt.Sprintf("ratelimit:block:%s", key)
+func (s *RedisStorage) Reset(ctx context.Context, key string) error {
+	windowKey := redisKey("req", key)
+	blockKey := redisKey("block", key)
+	bucketKey := redisKey("bucket", key)
+	slidingKey := redisKey("sliding", key)
+	logKey := redisKey("log", key)
+	gcraKey := redisKey("gcra", key)
+	offenseKey := redisKey("offense", key)
 	
-	cmd := s.client.Del(ctx, windowKey, blockKey)
+	cmd := s.client.Del(ctx, windowKey, blockKey, bucketKey, slidingKey, logKey, gcraKey, offenseKey)
 	if err := cmd.Err(); err != nil {
 		return fmt.Errorf("failed to reset rate limit data: %w", err)
 	}
 
 	return nil
 }
+
+// AllowFixedWindow checks the block, counts the request and blocks the key in a single round trip
+func (s *RedisStorage) AllowFixedWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (ratelimiter.Result, error) {
+	windowKey := redisKey("req", key)
+	blockKey := redisKey("block", key)
+
+	vals, err := fixedWindowScript.Run(ctx, s.client, []string{windowKey, blockKey},
+		now.UnixMilli(), window.Milliseconds(), limit, blockDuration.Milliseconds(), n,
+	).Int64Slice()
+	if err != nil {
+		return ratelimiter.Result{}, fmt.Errorf("failed to check fixed window: %w", err)
+	}
+
+	count := int(vals[1])
+	result := ratelimiter.Result{
+		Allowed:   vals[0] == 1,
+		Remaining: max(limit-count, 0),
+		Count:     count,
+	}
+	if vals[2] > 0 {
+		result.RetryAfter = time.UnixMilli(vals[2])
+	}
+	result.ResetAt = time.UnixMilli(vals[3])
+	return result, nil
+}
+
+// RefundFixedWindow uncounts n requests counted at counted, unless the key's window has reset since
+func (s *RedisStorage) RefundFixedWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	windowKey := redisKey("req", key)
+
+	err := refundFixedWindowScript.Run(ctx, s.client, []string{windowKey},
+		now.UnixMilli(), counted.UnixMilli(), window.Milliseconds(), n, refundTolerance(window).Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refund fixed window: %w", err)
+	}
+	return nil
+}
+
+// AllowTokenBucket refills the bucket for a key and takes n tokens if available
+func (s *RedisStorage) AllowTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) (ratelimiter.Result, error) {
+	bucketKey := redisKey("bucket", key)
+
+	// Rate is passed in tokens per millisecond to match the script's clock
+	vals, err := tokenBucketScript.Run(ctx, s.client, []string{bucketKey},
+		now.UnixMilli(), rate/1000, capacity, n,
+	).Int64Slice()
+	if err != nil {
+		return ratelimiter.Result{}, fmt.Errorf("failed to take token: %w", err)
+	}
+
+	return scriptResult(vals), nil
+}
+
+// RefundTokenBucket puts n tokens back in the key's bucket, up to capacity
+func (s *RedisStorage) RefundTokenBucket(ctx context.Context, key string, now time.Time, rate float64, capacity int, n int) error {
+	bucketKey := redisKey("bucket", key)
+
+	err := refundTokenBucketScript.Run(ctx, s.client, []string{bucketKey},
+		now.UnixMilli(), rate/1000, capacity, n,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refund tokens: %w", err)
+	}
+	return nil
+}
+
+// AllowSlidingWindow counts a request of cost n if the weighted count over the rolling window stays within the limit
+func (s *RedisStorage) AllowSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (ratelimiter.Result, error) {
+	slidingKey := redisKey("sliding", key)
+
+	vals, err := slidingWindowScript.Run(ctx, s.client, []string{slidingKey},
+		now.UnixMicro(), max(window.Microseconds(), 1), limit, n,
+	).Int64Slice()
+	if err != nil {
+		return ratelimiter.Result{}, fmt.Errorf("failed to count sliding window request: %w", err)
+	}
+
+	return scriptResult(vals), nil
+}
+
+// RefundSlidingWindow uncounts n requests counted at counted, unless the window they were
+// counted in is no longer the current one
+func (s *RedisStorage) RefundSlidingWindow(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	slidingKey := redisKey("sliding", key)
+
+	err := refundSlidingWindowScript.Run(ctx, s.client, []string{slidingKey},
+		now.UnixMicro(), counted.UnixMicro(), max(window.Microseconds(), 1), n,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refund sliding window: %w", err)
+	}
+	return nil
+}
+
+// AllowSlidingLog records a request of cost n if it fits within limit requests in the rolling window
+func (s *RedisStorage) AllowSlidingLog(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (ratelimiter.Result, error) {
+	logKey := redisKey("log", key)
+
+	// Requests made in the same millisecond need distinct members
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63())
+
+	vals, err := slidingLogScript.Run(ctx, s.client, []string{logKey},
+		now.UnixMilli(), window.Milliseconds(), limit, member, n,
+	).Int64Slice()
+	if err != nil {
+		return ratelimiter.Result{}, fmt.Errorf("failed to record request: %w", err)
+	}
+
+	return scriptResult(vals), nil
+}
+
+// RefundSlidingLog removes up to n entries recorded at counted that are still in the rolling window
+func (s *RedisStorage) RefundSlidingLog(ctx context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	logKey := redisKey("log", key)
+
+	err := refundSlidingLogScript.Run(ctx, s.client, []string{logKey},
+		now.UnixMilli(), counted.UnixMilli(), window.Milliseconds(), n,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refund sliding log: %w", err)
+	}
+	return nil
+}
+
+// AllowGCRA advances the key's theoretical arrival time by n emission intervals if the request conforms to the rate
+func (s *RedisStorage) AllowGCRA(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) (ratelimiter.Result, error) {
+	gcraKey := redisKey("gcra", key)
+
+	if limit <= 0 {
+		return ratelimiter.Result{Allowed: false, RetryAfter: now.Add(window), ResetAt: now.Add(window)}, nil
+	}
+	// Windows shorter than limit microseconds still allow at most one request per microsecond
+	interval := max(window.Microseconds()/int64(limit), 1)
+
+	vals, err := gcraScript.Run(ctx, s.client, []string{gcraKey},
+		now.UnixMicro(), interval, window.Microseconds(), n,
+	).Int64Slice()
+	if err != nil {
+		return ratelimiter.Result{}, fmt.Errorf("failed to update arrival time: %w", err)
+	}
+
+	return scriptResult(vals), nil
+}
+
+// RefundGCRA moves the key's theoretical arrival time back by n emission intervals, but not before now
+func (s *RedisStorage) RefundGCRA(ctx context.Context, key string, now time.Time, window time.Duration, limit int, n int) error {
+	gcraKey := redisKey("gcra", key)
+
+	if limit <= 0 {
+		return nil
+	}
+	interval := max(window.Microseconds()/int64(limit), 1)
+
+	err := refundGCRAScript.Run(ctx, s.client, []string{gcraKey},
+		now.UnixMicro(), interval, n,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refund arrival time: %w", err)
+	}
+	return nil
+}
+
+// AllowRules counts a request of cost n in every rule's window only if it fits within all of them
+func (s *RedisStorage) AllowRules(ctx context.Context, key string, now time.Time, rules []ratelimiter.Rule, n int) (bool, []ratelimiter.RuleState, error) {
+	keys := make([]string, len(rules))
+	args := []interface{}{now.UnixMilli(), n}
+	for i, rule := range rules {
+		keys[i] = ruleKey(key, rule)
+		args = append(args, rule.MaxRequests, rule.TimeWindow.Milliseconds())
+	}
+
+	vals, err := rulesScript.Run(ctx, s.client, keys, args...).Int64Slice()
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to check rules: %w", err)
+	}
+
+	states := make([]ratelimiter.RuleState, len(rules))
+	for i := range rules {
+		states[i] = ratelimiter.RuleState{
+			Count:   int(vals[1+2*i]),
+			ResetAt: time.UnixMilli(vals[2+2*i]),
+		}
+	}
+	return vals[0] == 1, states, nil
+}
+
+// RefundRules uncounts n requests counted at counted from every rule whose window hasn't reset since
+func (s *RedisStorage) RefundRules(ctx context.Context, key string, now, counted time.Time, rules []ratelimiter.Rule, n int) error {
+	keys := make([]string, len(rules))
+	args := []interface{}{now.UnixMilli(), counted.UnixMilli(), n}
+	for i, rule := range rules {
+		keys[i] = ruleKey(key, rule)
+		args = append(args, rule.TimeWindow.Milliseconds(), refundTolerance(rule.TimeWindow).Milliseconds())
+	}
+
+	if err := refundRulesScript.Run(ctx, s.client, keys, args...).Err(); err != nil {
+		return fmt.Errorf("failed to refund rules: %w", err)
+	}
+	return nil
+}
+
+// ResetRules resets the windows of the given rules for a key
+func (s *RedisStorage) ResetRules(ctx context.Context, key string, rules []ratelimiter.Rule) error {
+	keys := make([]string, len(rules))
+	for i, rule := range rules {
+		keys[i] = ruleKey(key, rule)
+	}
+
+	if err := s.client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to reset rules: %w", err)
+	}
+	return nil
+}
+
+// AddOffense records an offense for a key and returns the number of offenses within the decay period
+func (s *RedisStorage) AddOffense(ctx context.Context, key string, now time.Time, decay time.Duration) (int, error) {
+	offenseKey := redisKey("offense", key)
+
+	count, err := offenseScript.Run(ctx, s.client, []string{offenseKey}, decay.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to record offense: %w", err)
+	}
+	return int(count), nil
+}
+
+// ruleKey returns the request counter key of a rule
+func ruleKey(key string, rule ratelimiter.Rule) string {
+	return fmt.Sprintf("%s:%s:%d", redisKey("rule", key), rule.Name, rule.TimeWindow.Milliseconds())
+}
+
+// refundTolerance is how long after the refunded requests were counted their window
+// may seem to start. Redis times windows by its own clock, so the window started by
+// a refunded request seems to start up to a round trip after the request was counted.
+func refundTolerance(window time.Duration) time.Duration {
+	return min(window/10, 100*time.Millisecond)
+}
+
+// redisKey returns the Redis key holding one kind of state of a client key.
+// The client key is a hash tag, so in Redis Cluster all state of a client
+// lands on the same slot and can be used by a single script. Earlier versions
+// used "ratelimit:<kind>:<key>" without the hash tag, which is never read, so
+// upgrading resets all state.
+func redisKey(kind, key string) string {
+	return "ratelimit:" + kind + ":{" + key + "}"
+}
+
+// scriptResult converts an {allowed, remaining, retry after, reset} script reply into a Result
+func scriptResult(vals []int64) ratelimiter.Result {
+	result := ratelimiter.Result{
+		Allowed:   vals[0] == 1,
+		Remaining: int(vals[1]),
+		ResetAt:   time.UnixMilli(vals[3]),
+	}
+	if vals[2] > 0 {
+		result.RetryAfter = time.UnixMilli(vals[2])
+	}
+	return result
+}
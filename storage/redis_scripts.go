@@ -0,0 +1,462 @@
+package storage
+
+import "github.com/redis/go-redis/v9"
+
+// Lua scripts executed atomically by RedisStorage. Scripts are run with
+// EVALSHA and fall back to EVAL when Redis doesn't have them cached yet.
+
+// fixedWindowScript checks the block, counts the request and blocks the key in one step
+//
+// KEYS[1]: request counter key
+// KEYS[2]: block key, holding the block expiration in milliseconds
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: window length in milliseconds
+// ARGV[3]: maximum requests per window
+// ARGV[4]: block duration in milliseconds
+// ARGV[5]: request cost
+//
+// Returns {allowed, requests counted, retry after in milliseconds, reset in milliseconds}
+var fixedWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local block = tonumber(ARGV[4])
+local n = tonumber(ARGV[5])
+
+local blocked_until = tonumber(redis.call('GET', KEYS[2]))
+if blocked_until and blocked_until > now then
+	return {0, limit, blocked_until, blocked_until}
+end
+
+local count = redis.call('INCRBY', KEYS[1], n)
+-- Start the window on its first request, and repair counters left without an expiry
+if count == n or redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], window)
+end
+
+local reset = now + redis.call('PTTL', KEYS[1])
+if count <= limit then
+	return {1, count, 0, reset}
+end
+
+-- Without a block duration the key is limited until the window resets
+if block <= 0 then
+	return {0, count, reset, reset}
+end
+
+blocked_until = now + block
+redis.call('SET', KEYS[2], blocked_until, 'PX', block)
+return {0, count, blocked_until, blocked_until}
+`)
+
+// tokenBucketScript refills and takes a token from a bucket stored as a hash
+//
+// KEYS[1]: bucket key
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: refill rate in tokens per millisecond
+// ARGV[3]: bucket capacity
+// ARGV[4]: tokens to take
+//
+// Returns {allowed, tokens left, retry after in milliseconds, reset in milliseconds}
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+
+-- Refill tokens for the time elapsed since the last update
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+	ts = now
+end
+
+local allowed = 0
+local retry = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	retry = now + math.ceil((n - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', ts)
+-- A full bucket is the same as a missing one, so expire once refilled
+local refill = math.ceil((capacity - tokens) / rate)
+redis.call('PEXPIRE', KEYS[1], refill + 1)
+
+return {allowed, math.floor(tokens), retry, now + refill}
+`)
+
+// slidingWindowScript counts a request in a sliding window counter stored as a hash
+//
+// KEYS[1]: window key
+// ARGV[1]: current time in microseconds
+// ARGV[2]: window length in microseconds
+// ARGV[3]: maximum requests per window
+// ARGV[4]: request cost
+//
+// Returns {allowed, requests left, retry after in milliseconds, reset in milliseconds}
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+-- Windows are aligned to the Unix epoch so every instance agrees on their boundaries
+local start = now - (now % window)
+
+local state = redis.call('HMGET', KEYS[1], 'start', 'prev', 'curr')
+local last = tonumber(state[1])
+local prev, curr = 0, 0
+if last and start <= last then
+	-- A caller racing behind the latest window is counted in it
+	start = last
+	prev = tonumber(state[2])
+	curr = tonumber(state[3])
+elseif last and start == last + window then
+	prev = tonumber(state[3])
+end
+
+-- The quota is fully restored once the weights of both windows have decayed
+local function reset_at(prev, curr)
+	if curr > 0 then
+		return math.ceil((start + 2 * window) / 1000)
+	elseif prev > 0 then
+		return math.ceil((start + window) / 1000)
+	end
+	return math.ceil(now / 1000)
+end
+
+local elapsed = math.max(now - start, 0)
+local estimate = prev * (window - elapsed) / window + curr
+if estimate + n <= limit then
+	curr = curr + n
+	redis.call('HSET', KEYS[1], 'start', start, 'prev', prev, 'curr', curr)
+	redis.call('PEXPIRE', KEYS[1], math.ceil((start + 2 * window - now) / 1000))
+	return {1, math.floor(limit - estimate - n), 0, reset_at(prev, curr)}
+end
+
+local retry
+if curr + n > limit then
+	-- The current window is full: wait until its weight, as the previous window, decays enough
+	retry = start + window
+	if curr > 0 then
+		retry = retry + math.max(math.ceil(window * (1 - (limit - n) / curr)), 0)
+	end
+else
+	-- Otherwise wait until the previous window's weight decays enough
+	retry = start + math.ceil(window * (1 - (limit - curr - n) / prev))
+end
+
+return {0, 0, math.ceil(retry / 1000), reset_at(prev, curr)}
+`)
+
+// slidingLogScript records a request in a sliding window log stored as a sorted set
+//
+// KEYS[1]: log key, scored by request time
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: window length in milliseconds
+// ARGV[3]: maximum requests per window
+// ARGV[4]: unique member prefix for this request
+// ARGV[5]: request cost, recorded as that many entries
+//
+// Returns {allowed, requests left, retry after in milliseconds, reset in milliseconds}
+var slidingLogScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local n = tonumber(ARGV[5])
+
+if n > limit then
+	return {0, 0, now + window, now + window}
+end
+
+-- Prune requests that left the rolling window
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+
+-- The quota is fully restored once the newest request leaves the window
+local function reset_at()
+	local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	if #newest == 0 then
+		return now
+	end
+	return tonumber(newest[2]) + window
+end
+
+local count = redis.call('ZCARD', KEYS[1])
+if count + n <= limit then
+	for i = 1, n do
+		redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+	end
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, limit - count - n, 0, now + window}
+end
+
+-- Enough of the oldest requests must leave the window to make room for n more
+local index = count + n - limit - 1
+local entry = redis.call('ZRANGE', KEYS[1], index, index, 'WITHSCORES')
+return {0, 0, tonumber(entry[2]) + window, reset_at()}
+`)
+
+// gcraScript applies the generic cell rate algorithm to a single theoretical arrival time
+//
+// KEYS[1]: theoretical arrival time key
+// ARGV[1]: current time in microseconds
+// ARGV[2]: emission interval in microseconds
+// ARGV[3]: burst tolerance in microseconds
+// ARGV[4]: request cost, in emission intervals
+//
+// Returns {allowed, requests left, retry after in milliseconds, reset in milliseconds}
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+local new_tat = math.max(tat, now) + interval * n
+
+-- Requests arriving earlier than the burst tolerance allows don't conform.
+-- The full burst is available again once the arrival time is reached.
+local allow_at = new_tat - tolerance
+if now < allow_at then
+	return {0, 0, math.ceil(allow_at / 1000), math.ceil(math.max(tat, now) / 1000)}
+end
+
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / interval), 0, math.ceil(new_tat / 1000)}
+`)
+
+// rulesScript counts a request in several fixed windows only if it fits within all of them
+//
+// KEYS[i]: request counter key for rule i
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: request cost
+// ARGV[1+2i]: maximum requests for rule i
+// ARGV[2+2i]: window length in milliseconds for rule i
+//
+// Returns {allowed, count for rule 1, reset for rule 1 in milliseconds, count for rule 2, ...}
+var rulesScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+
+local allowed = 1
+local counts, ttls = {}, {}
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[1 + 2 * i])
+	counts[i] = tonumber(redis.call('GET', key)) or 0
+	ttls[i] = redis.call('PTTL', key)
+	if counts[i] + n > limit then
+		allowed = 0
+	end
+end
+
+local reply = {allowed}
+for i, key in ipairs(KEYS) do
+	local window = tonumber(ARGV[2 + 2 * i])
+	if allowed == 1 then
+		counts[i] = redis.call('INCRBY', key, n)
+		if ttls[i] < 0 then
+			-- Start the window on its first request, and repair counters left without an expiry
+			redis.call('PEXPIRE', key, window)
+		end
+	end
+	if ttls[i] < 0 then
+		ttls[i] = window
+	end
+	table.insert(reply, counts[i])
+	table.insert(reply, now + ttls[i])
+end
+
+return reply
+`)
+
+// refundFixedWindowScript uncounts requests from a fixed window unless it has reset since they were counted
+//
+// KEYS[1]: request counter key
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: time the requests were counted in milliseconds
+// ARGV[3]: window length in milliseconds
+// ARGV[4]: requests to uncount
+// ARGV[5]: tolerance for the window start in milliseconds
+//
+// Returns the number of requests uncounted
+var refundFixedWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local counted = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local tolerance = tonumber(ARGV[5])
+
+-- The window started a window length before it expires, and requests counted
+-- before it started belong to an earlier window
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 or now + ttl - window > counted + tolerance then
+	return 0
+end
+
+-- Windows left empty are dropped
+n = math.min(n, tonumber(redis.call('GET', KEYS[1])))
+if redis.call('DECRBY', KEYS[1], n) <= 0 then
+	redis.call('DEL', KEYS[1])
+end
+return n
+`)
+
+// refundRulesScript uncounts requests from every rule window that hasn't reset since they were counted
+//
+// KEYS[i]: request counter key for rule i
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: time the requests were counted in milliseconds
+// ARGV[3]: requests to uncount
+// ARGV[2+2i]: window length in milliseconds for rule i
+// ARGV[3+2i]: tolerance for the window start in milliseconds for rule i
+//
+// Returns the number of windows refunded
+var refundRulesScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local counted = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local refunded = 0
+for i, key in ipairs(KEYS) do
+	local window = tonumber(ARGV[2 + 2 * i])
+	local tolerance = tonumber(ARGV[3 + 2 * i])
+	local ttl = redis.call('PTTL', key)
+	if ttl >= 0 and now + ttl - window <= counted + tolerance then
+		if redis.call('DECRBY', key, math.min(n, tonumber(redis.call('GET', key)))) <= 0 then
+			redis.call('DEL', key)
+		end
+		refunded = refunded + 1
+	end
+end
+return refunded
+`)
+
+// refundTokenBucketScript refills a bucket and puts tokens back, up to its capacity
+//
+// KEYS[1]: bucket key
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: refill rate in tokens per millisecond
+// ARGV[3]: bucket capacity
+// ARGV[4]: tokens to put back
+//
+// Returns the tokens in the bucket
+var refundTokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+-- A missing bucket is full already
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+if not state[1] then
+	return capacity
+end
+
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if now > ts then
+	tokens = tokens + (now - ts) * rate
+	ts = now
+end
+tokens = math.min(capacity, tokens + n)
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1)
+return math.floor(tokens)
+`)
+
+// refundSlidingWindowScript uncounts requests from a sliding window counter if the window
+// they were counted in is still the current one
+//
+// KEYS[1]: window key
+// ARGV[1]: current time in microseconds
+// ARGV[2]: time the requests were counted in microseconds
+// ARGV[3]: window length in microseconds
+// ARGV[4]: requests to uncount
+//
+// Returns the number of requests uncounted
+var refundSlidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local counted = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local start = counted - (counted % window)
+local state = redis.call('HMGET', KEYS[1], 'start', 'curr')
+if tonumber(state[1]) ~= start or now - start >= window then
+	return 0
+end
+
+n = math.min(n, tonumber(state[2]))
+redis.call('HSET', KEYS[1], 'curr', tonumber(state[2]) - n)
+return n
+`)
+
+// refundSlidingLogScript removes entries recorded at a given time that are still in the rolling window
+//
+// KEYS[1]: log key, scored by request time
+// ARGV[1]: current time in milliseconds
+// ARGV[2]: time the entries were recorded in milliseconds
+// ARGV[3]: window length in milliseconds
+// ARGV[4]: entries to remove
+//
+// Returns the number of entries removed
+var refundSlidingLogScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local counted = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+
+if counted <= now - window then
+	return 0
+end
+
+local entries = redis.call('ZRANGEBYSCORE', KEYS[1], counted, counted, 'LIMIT', 0, ARGV[4])
+if #entries == 0 then
+	return 0
+end
+return redis.call('ZREM', KEYS[1], unpack(entries))
+`)
+
+// refundGCRAScript moves a theoretical arrival time back, but not before the current time
+//
+// KEYS[1]: theoretical arrival time key
+// ARGV[1]: current time in microseconds
+// ARGV[2]: emission interval in microseconds
+// ARGV[3]: requests to refund, in emission intervals
+//
+// Returns the new theoretical arrival time in microseconds
+var refundGCRAScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat then
+	return now
+end
+
+-- An arrival time in the present is the same as no state
+tat = tat - tonumber(ARGV[2]) * tonumber(ARGV[3])
+if tat <= now then
+	redis.call('DEL', KEYS[1])
+	return now
+end
+
+redis.call('SET', KEYS[1], tat, 'PX', math.ceil((tat - now) / 1000))
+return tat
+`)
+
+// offenseScript counts an offense, forgetting earlier ones once the key behaved for the decay period
+//
+// KEYS[1]: offense counter key
+// ARGV[1]: decay period in milliseconds
+//
+// Returns the number of offenses counted
+var offenseScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return count
+`)
@@ -3,9 +3,11 @@ package storage
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -34,7 +36,7 @@ func TestRedisStorage(t *testing.T) {
 	storage := NewRedisStorage(client)
 
 	// Test increment requests
-	count, err := storage.IncrementRequests("test-ip", time.Now())
+	count, err := storage.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -43,7 +45,7 @@ func TestRedisStorage(t *testing.T) {
 	}
 
 	// Test get requests
-	count, err = storage.GetRequests("test-ip")
+	count, err = storage.GetRequests(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -53,13 +55,13 @@ func TestRedisStorage(t *testing.T) {
 
 	// Test block
 	blockUntil := time.Now().Add(time.Minute)
-	err = storage.Block("test-ip", blockUntil)
+	err = storage.Block(ctx, "test-ip", blockUntil)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
 	// Test is blocked
-	blocked, retryAfter, err := storage.IsBlocked("test-ip")
+	blocked, retryAfter, err := storage.IsBlocked(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -71,12 +73,12 @@ func TestRedisStorage(t *testing.T) {
 	}
 
 	// Test reset
-	err = storage.Reset("test-ip")
+	err = storage.Reset(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	count, err = storage.GetRequests("test-ip")
+	count, err = storage.GetRequests(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -97,13 +99,13 @@ func TestRedisStorageExpiration(t *testing.T) {
 
 	// Test that requests expire after window
 	now := time.Now()
-	_, err := storage.IncrementRequests("test-ip", now)
+	_, err := storage.IncrementRequests(ctx, "test-ip", now, time.Minute, 1)
 	if err != nil {
 		t.Fatalf("Failed to increment requests: %v", err)
 	}
 
 	// Verify key exists
-	count, err := storage.GetRequests("test-ip")
+	count, err := storage.GetRequests(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error checking count, got %v", err)
 	}
@@ -112,7 +114,7 @@ func TestRedisStorageExpiration(t *testing.T) {
 	}
 
 	// Force key expiration by setting a short TTL
-	windowKey := fmt.Sprintf("ratelimit:req:%s", "test-ip")
+	windowKey := fmt.Sprintf("ratelimit:req:{%s}", "test-ip")
 	err = client.Expire(ctx, windowKey, 1*time.Second).Err()
 	if err != nil {
 		t.Fatalf("Failed to set expiration: %v", err)
@@ -122,7 +124,7 @@ func TestRedisStorageExpiration(t *testing.T) {
 	time.Sleep(1100 * time.Millisecond)
 
 	// Verify key is gone
-	count, err = storage.GetRequests("test-ip")
+	count, err = storage.GetRequests(ctx, "test-ip")
 	if err != nil {
 		t.Errorf("Expected no error after expiration, got %v", err)
 	}
@@ -130,3 +132,752 @@ func TestRedisStorageExpiration(t *testing.T) {
 		t.Errorf("Expected count 0 after expiration, got %d", count)
 	}
 }
+
+func TestRedisStorageTokenBucket(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	now := time.Now()
+
+	// Burst up to the bucket capacity
+	for i := 0; i < 3; i++ {
+		result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 3, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("Expected %d tokens left, got %d", 2-i, result.Remaining)
+		}
+	}
+
+	// Bucket is empty
+	result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be denied with an empty bucket")
+	}
+	if result.RetryAfter.UnixMilli() != now.Add(time.Second).UnixMilli() {
+		t.Errorf("Expected retry after %v, got %v", now.Add(time.Second), result.RetryAfter)
+	}
+
+	// One token is refilled after a second
+	result, err = storage.AllowTokenBucket(ctx, "test-ip", now.Add(time.Second), 1, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after refill")
+	}
+}
+
+func TestRedisStorageSlidingWindow(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	window := time.Minute
+	start := time.Now().Truncate(window)
+
+	// Fill the limit right before the window boundary
+	for i := 0; i < 10; i++ {
+		result, err := storage.AllowSlidingWindow(ctx, "test-ip", start.Add(window-time.Second), window, 10, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	// Crossing the boundary doesn't reset the limit
+	next := start.Add(window)
+	result, err := storage.AllowSlidingWindow(ctx, "test-ip", next, window, 10, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request right after the window boundary to be denied")
+	}
+	if !result.RetryAfter.Equal(next.Add(window / 10)) {
+		t.Errorf("Expected retry after %v, got %v", next.Add(window/10), result.RetryAfter)
+	}
+
+	// Halfway through the next window the previous one weighs half
+	for i := 0; i < 5; i++ {
+		result, err = storage.AllowSlidingWindow(ctx, "test-ip", next.Add(window/2), window, 10, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	result, err = storage.AllowSlidingWindow(ctx, "test-ip", next.Add(window/2), window, 10, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the weighted limit to be denied")
+	}
+}
+
+func TestRedisStorageSlidingWindowSubMillisecond(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	window := 500 * time.Microsecond
+	now := time.Now()
+
+	// Keys of sub-millisecond windows expire within a millisecond, so every
+	// check stands on its own
+	result, err := storage.AllowSlidingWindow(ctx, "test-ip", now, window, 1, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the limit to be denied")
+	}
+	if !result.RetryAfter.After(now) || result.RetryAfter.After(now.Add(window+time.Millisecond)) {
+		t.Errorf("Expected retry within a window after %v, got %v", now, result.RetryAfter)
+	}
+
+	result, err = storage.AllowSlidingWindow(ctx, "test-ip", now, window, 1, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed")
+	}
+	if !result.ResetAt.After(now) {
+		t.Errorf("Expected reset after %v, got %v", now, result.ResetAt)
+	}
+}
+
+func TestRedisStorageSlidingLog(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	window := 10 * time.Second
+	start := time.Now()
+
+	// Record one request per second up to the limit
+	for i := 0; i < 3; i++ {
+		result, err := storage.AllowSlidingLog(ctx, "test-ip", start.Add(time.Duration(i)*time.Second), window, 3, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("Expected %d requests left, got %d", 2-i, result.Remaining)
+		}
+	}
+
+	// The log is full until the oldest request leaves the window
+	result, err := storage.AllowSlidingLog(ctx, "test-ip", start.Add(3*time.Second), window, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be denied with a full log")
+	}
+	if result.RetryAfter.UnixMilli() != start.Add(10*time.Second).UnixMilli() {
+		t.Errorf("Expected retry after %v, got %v", start.Add(10*time.Second), result.RetryAfter)
+	}
+
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", start.Add(window), window, 3, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed once the oldest request left the window")
+	}
+	if result.Remaining != 0 {
+		t.Errorf("Expected 0 requests left, got %d", result.Remaining)
+	}
+}
+
+func TestRedisStorageGCRA(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	window := 10 * time.Second
+	start := time.Now().Truncate(time.Millisecond)
+
+	// Burst up to the limit
+	for i := 0; i < 5; i++ {
+		result, err := storage.AllowGCRA(ctx, "test-ip", start, window, 5, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != 4-i {
+			t.Errorf("Expected %d requests left, got %d", 4-i, result.Remaining)
+		}
+	}
+
+	// The next request conforms one emission interval later
+	result, err := storage.AllowGCRA(ctx, "test-ip", start, window, 5, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the burst to be denied")
+	}
+	if result.RetryAfter.UnixMilli() != start.Add(2*time.Second).UnixMilli() {
+		t.Errorf("Expected retry after %v, got %v", start.Add(2*time.Second), result.RetryAfter)
+	}
+
+	result, err = storage.AllowGCRA(ctx, "test-ip", start.Add(2*time.Second), window, 5, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after one emission interval")
+	}
+}
+
+func TestRedisStorageGCRAShortWindow(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	// A window shorter than the limit in microseconds allows one request per microsecond
+	window := time.Millisecond
+	now := time.Now()
+
+	result, err := storage.AllowGCRA(ctx, "test-ip", now, window, 10000, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed")
+	}
+	if result.Remaining != 999 {
+		t.Errorf("Expected 999 requests left, got %d", result.Remaining)
+	}
+
+	if err := storage.RefundGCRA(ctx, "test-ip", now, window, 10000, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestRedisStorageTimeWindow(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+
+	// Hourly windows expire after an hour
+	if _, err := storage.IncrementRequests(ctx, "hourly", time.Now(), time.Hour, 1); err != nil {
+		t.Fatalf("Failed to increment requests: %v", err)
+	}
+	ttl, err := client.PTTL(ctx, "ratelimit:req:{hourly}").Result()
+	if err != nil {
+		t.Fatalf("Failed to get TTL: %v", err)
+	}
+	if ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected TTL close to an hour, got %v", ttl)
+	}
+
+	// Per-second windows reset after a second
+	for i := 1; i <= 2; i++ {
+		count, err := storage.IncrementRequests(ctx, "per-second", time.Now(), time.Second, 1)
+		if err != nil {
+			t.Fatalf("Failed to increment requests: %v", err)
+		}
+		if count != i {
+			t.Errorf("Expected count %d, got %d", i, count)
+		}
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	count, err := storage.IncrementRequests(ctx, "per-second", time.Now(), time.Second, 1)
+	if err != nil {
+		t.Fatalf("Failed to increment requests: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected count 1 in the next window, got %d", count)
+	}
+}
+
+func TestRedisStorageFixedWindow(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	now := time.Now()
+
+	// Requests up to the limit are allowed
+	for i := 1; i <= 2; i++ {
+		result, err := storage.AllowFixedWindow(ctx, "test-ip", now, time.Minute, 2, time.Minute, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		if result.Count != i || result.Remaining != 2-i {
+			t.Errorf("Expected count %d and %d left, got %+v", i, 2-i, result)
+		}
+	}
+
+	// The window expires even though it was created by the script
+	ttl, err := client.PTTL(ctx, "ratelimit:req:{test-ip}").Result()
+	if err != nil {
+		t.Fatalf("Failed to get TTL: %v", err)
+	}
+	if ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected window to expire within a minute, got %v", ttl)
+	}
+
+	// Exceeding the limit blocks the key
+	result, err := storage.AllowFixedWindow(ctx, "test-ip", now, time.Minute, 2, time.Minute, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request over the limit to be denied")
+	}
+	if result.RetryAfter.UnixMilli() != now.Add(time.Minute).UnixMilli() {
+		t.Errorf("Expected retry after %v, got %v", now.Add(time.Minute), result.RetryAfter)
+	}
+
+	// The block is visible through IsBlocked
+	blocked, retryAfter, err := storage.IsBlocked(ctx, "test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !blocked || !retryAfter.Equal(result.RetryAfter) {
+		t.Errorf("Expected key to be blocked until %v, got %v (blocked: %v)", result.RetryAfter, retryAfter, blocked)
+	}
+}
+
+func TestRedisStorageWeightedRequests(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	now := time.Now()
+
+	// Fixed windows count the full cost
+	for _, tc := range []struct{ n, want int }{{5, 5}, {3, 8}} {
+		count, err := storage.IncrementRequests(ctx, "test-ip", now, time.Minute, tc.n)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if count != tc.want {
+			t.Errorf("Expected count %d, got %d", tc.want, count)
+		}
+	}
+
+	// A request only fits if its whole cost fits
+	result, err := storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 5, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("Expected request of cost 3 to be allowed with 2 left, got %+v", result)
+	}
+
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 5, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request of cost 3 to be denied with 2 left")
+	}
+
+	result, err = storage.AllowTokenBucket(ctx, "test-ip", now, 1, 10, 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected request of cost 10 to empty the bucket, got %+v", result)
+	}
+}
+
+func TestRedisStorageRules(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	rules := []ratelimiter.Rule{
+		{Name: "second", MaxRequests: 2, TimeWindow: time.Second},
+		{Name: "minute", MaxRequests: 3, TimeWindow: time.Minute},
+	}
+	now := time.Now()
+
+	// The per-second rule allows two requests
+	for i := 1; i <= 2; i++ {
+		allowed, states, err := storage.AllowRules(ctx, "test-ip", now, rules, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		if states[0].Count != i || states[1].Count != i {
+			t.Errorf("Expected both rules to count %d, got %+v", i, states)
+		}
+	}
+
+	// A denied request isn't counted by any rule
+	allowed, states, err := storage.AllowRules(ctx, "test-ip", now, rules, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed {
+		t.Error("Expected request over the per-second rule to be denied")
+	}
+	if states[1].Count != 2 {
+		t.Errorf("Expected the per-minute rule to still count 2, got %d", states[1].Count)
+	}
+
+	// Once the per-second rule is reset, the per-minute rule trips
+	if err := storage.ResetRules(ctx, "test-ip", rules[:1]); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	allowed, _, err = storage.AllowRules(ctx, "test-ip", now, rules, 1)
+	if err != nil || !allowed {
+		t.Fatalf("Expected request to be allowed after the per-second reset, got %v (%v)", allowed, err)
+	}
+	allowed, states, err = storage.AllowRules(ctx, "test-ip", now, rules, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed {
+		t.Error("Expected request over the per-minute rule to be denied")
+	}
+	if states[1].Count != 3 {
+		t.Errorf("Expected the per-minute rule to count 3, got %d", states[1].Count)
+	}
+	if states[1].ResetAt.Before(now.Add(59*time.Second)) || states[1].ResetAt.After(now.Add(time.Minute)) {
+		t.Errorf("Expected the per-minute rule to reset in a minute, got %v", states[1].ResetAt)
+	}
+}
+
+func TestRedisStorageRefund(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	now := time.UnixMilli(time.Now().UnixMilli())
+
+	// Fixed window counts never go below zero
+	if _, err := storage.IncrementRequests(ctx, "test-ip", now, time.Minute, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, want := range []int{1, 0, 0} {
+		if err := storage.RefundFixedWindow(ctx, "test-ip", now, now, time.Minute, 1); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if count, _ := storage.GetRequests(ctx, "test-ip"); count != want {
+			t.Errorf("Expected count %d after refund, got %d", want, count)
+		}
+	}
+
+	// Requests counted in an earlier window aren't refunded from the current one
+	first := time.Now()
+	if _, err := storage.IncrementRequests(ctx, "rolled", first, 50*time.Millisecond, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	later := time.Now()
+	if _, err := storage.IncrementRequests(ctx, "rolled", later, 50*time.Millisecond, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundFixedWindow(ctx, "rolled", later, first, 50*time.Millisecond, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "rolled"); count != 1 {
+		t.Errorf("Expected refund from an earlier window to be skipped, got count %d", count)
+	}
+
+	// Refunds through the atomic fixed window leave the block in place
+	for i := 0; i < 2; i++ {
+		if _, err := storage.AllowFixedWindow(ctx, "atomic", now, time.Minute, 1, time.Minute, 1); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if err := storage.RefundFixedWindow(ctx, "atomic", now, now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "atomic"); count != 1 {
+		t.Errorf("Expected count 1 after refund, got %d", count)
+	}
+
+	// A refunded token can be taken again, and refunds don't overflow the bucket
+	if _, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 1, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundTokenBucket(ctx, "test-ip", now, 1, 1, 5); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err := storage.AllowTokenBucket(ctx, "test-ip", now, 1, 1, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected the single refunded token to be available, got %+v", result)
+	}
+
+	// Sliding window refunds only apply to the window they were counted in
+	if _, err := storage.AllowSlidingWindow(ctx, "test-ip", now, time.Minute, 2, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundSlidingWindow(ctx, "test-ip", now.Add(time.Minute), now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result, _ := storage.AllowSlidingWindow(ctx, "test-ip", now, time.Minute, 2, 1); result.Allowed {
+		t.Error("Expected refund from an earlier window to be skipped")
+	}
+	if err := storage.RefundSlidingWindow(ctx, "test-ip", now, now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result, _ := storage.AllowSlidingWindow(ctx, "test-ip", now, time.Minute, 2, 1); !result.Allowed {
+		t.Error("Expected refunded request to be allowed")
+	}
+
+	// Refunds drop the entries of the refunded request
+	if _, err := storage.AllowSlidingLog(ctx, "test-ip", now.Add(-time.Second), time.Minute, 3, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 3, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundSlidingLog(ctx, "test-ip", now, now, time.Minute, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 3, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected the refunded entries to be available, got %+v", result)
+	}
+
+	// Refunds move the arrival time back
+	if _, err := storage.AllowGCRA(ctx, "test-ip", now, time.Minute, 1, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundGCRA(ctx, "test-ip", now, time.Minute, 1, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err = storage.AllowGCRA(ctx, "test-ip", now, time.Minute, 1, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected refunded request to be allowed")
+	}
+
+	// Rule refunds skip rules whose window reset
+	rules := []ratelimiter.Rule{
+		{Name: "burst", MaxRequests: 1, TimeWindow: 50 * time.Millisecond},
+		{Name: "minute", MaxRequests: 2, TimeWindow: time.Minute},
+	}
+	first = time.Now()
+	if _, _, err := storage.AllowRules(ctx, "test-ip", first, rules, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	later = time.Now()
+	if _, _, err := storage.AllowRules(ctx, "test-ip", later, rules, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RefundRules(ctx, "test-ip", later, first, rules, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	allowed, states, err := storage.AllowRules(ctx, "test-ip", later, rules, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed || states[1].Count != 1 {
+		t.Errorf("Expected only the per-minute rule to be refunded, got allowed %v and %+v", allowed, states)
+	}
+}
+
+func TestRedisStorageResetAt(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	now := time.UnixMilli(time.Now().UnixMilli())
+
+	// The fixed window resets a window length after its first request
+	result, err := storage.AllowFixedWindow(ctx, "test-ip", now, time.Minute, 2, time.Minute, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.ResetAt.Before(now) || result.ResetAt.After(now.Add(time.Minute)) {
+		t.Errorf("Expected window to reset within a minute, got %v", result.ResetAt)
+	}
+
+	// An emptied bucket is full again after refilling at 1 token per second
+	result, err = storage.AllowTokenBucket(ctx, "test-ip", now, 1, 2, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.ResetAt.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("Expected bucket to be full at %v, got %v", now.Add(2*time.Second), result.ResetAt)
+	}
+
+	// The log resets once its newest request leaves the window
+	storage.AllowSlidingLog(ctx, "test-ip", now, time.Minute, 2, 1)
+	result, err = storage.AllowSlidingLog(ctx, "test-ip", now.Add(time.Second), time.Minute, 2, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.ResetAt.Equal(now.Add(time.Second + time.Minute)) {
+		t.Errorf("Expected log to reset at %v, got %v", now.Add(time.Second+time.Minute), result.ResetAt)
+	}
+
+	// The full burst is available again at the theoretical arrival time
+	result, err = storage.AllowGCRA(ctx, "test-ip", now, time.Minute, 2, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.ResetAt.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Expected arrival time %v, got %v", now.Add(30*time.Second), result.ResetAt)
+	}
+}
+
+func TestRedisStorageEscalation(t *testing.T) {
+	client := setupRedisClient(t)
+	defer client.Close()
+
+	// Clean up any existing data
+	ctx := context.Background()
+	client.FlushAll(ctx)
+
+	storage := NewRedisStorage(client)
+	limiter := ratelimiter.New(storage, ratelimiter.WithMaxRequests(1), ratelimiter.WithEscalation(ratelimiter.Escalation{
+		Durations: []time.Duration{10 * time.Millisecond, time.Hour},
+	}))
+
+	// The first offense gets the first block
+	limiter.Allow("test-ip")
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed || resp.Offenses != 1 {
+		t.Fatalf("Expected first offense, got %+v", resp)
+	}
+
+	// Offending again once the block expires escalates it
+	time.Sleep(15 * time.Millisecond)
+	resp, err = limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed || resp.Offenses != 2 {
+		t.Fatalf("Expected second offense, got %+v", resp)
+	}
+
+	blocked, retryAfter, err := storage.IsBlocked(ctx, "test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !blocked || retryAfter.UnixMilli() != resp.RetryAfter.UnixMilli() {
+		t.Errorf("Expected key to be blocked until %v, got %v (blocked: %v)", resp.RetryAfter, retryAfter, blocked)
+	}
+
+	// The offense counter is persisted until it decays
+	ttl, err := client.PTTL(ctx, "ratelimit:offense:{test-ip}").Result()
+	if err != nil {
+		t.Fatalf("Failed to get TTL: %v", err)
+	}
+	if ttl <= 23*time.Hour {
+		t.Errorf("Expected offenses to be kept for the default decay of 24 hours, got %v", ttl)
+	}
+}
+
+func TestRedisKeysHashSlot(t *testing.T) {
+	// hashTag returns the part of a key Redis Cluster hashes to pick its slot
+	hashTag := func(key string) string {
+		if start := strings.IndexByte(key, '{'); start >= 0 {
+			if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+				return key[start+1 : start+1+end]
+			}
+		}
+		return key
+	}
+
+	for _, key := range []string{"192.0.2.1", "header:X-Api-Key:abc", "a}b", "x{y}"} {
+		keys := []string{
+			redisKey("req", key),
+			redisKey("block", key),
+			redisKey("bucket", key),
+			redisKey("offense", key),
+			ruleKey(key, ratelimiter.Rule{Name: "minute", TimeWindow: time.Minute}),
+		}
+		for _, k := range keys[1:] {
+			if hashTag(k) != hashTag(keys[0]) {
+				t.Errorf("Expected %q and %q to share a hash slot", keys[0], k)
+			}
+		}
+	}
+}
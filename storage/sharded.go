@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"context"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+// shardedEntry is the fixed window state of a key. Entries are stored by
+// value, so counting a request for a known key doesn't allocate.
+type shardedEntry struct {
+	start   int64 // window start in Unix nanoseconds
+	count   int
+	block   int64 // blocked until, in Unix nanoseconds
+	expires int64 // when the state has gone stale, in Unix nanoseconds
+}
+
+// shard guards the keys hashed to it. It is padded to a cache line so that
+// locking a shard doesn't contend with its neighbours.
+type shard struct {
+	mu      sync.Mutex
+	entries map[string]shardedEntry
+	_       [48]byte
+}
+
+// ShardedOptions configures a ShardedMemoryStorage
+type ShardedOptions struct {
+	Shards          int           // Number of shards, rounded up to a power of two
+	ShardCapacity   int           // Keys preallocated in each shard
+	CleanupInterval time.Duration // Interval between removals of stale keys, disabled when zero
+}
+
+// ShardedOption is a function that configures ShardedOptions
+type ShardedOption func(*ShardedOptions)
+
+// WithShards sets the number of shards. More shards reduce lock contention
+// between keys at the cost of memory.
+func WithShards(n int) ShardedOption {
+	return func(o *ShardedOptions) {
+		o.Shards = n
+	}
+}
+
+// WithShardCapacity preallocates room for n keys in each shard
+func WithShardCapacity(n int) ShardedOption {
+	return func(o *ShardedOptions) {
+		o.ShardCapacity = n
+	}
+}
+
+// WithShardedCleanupInterval sets how often stale keys are removed in the
+// background. The storage must be closed to stop the janitor.
+func WithShardedCleanupInterval(d time.Duration) ShardedOption {
+	return func(o *ShardedOptions) {
+		o.CleanupInterval = d
+	}
+}
+
+// ShardedMemoryStorage is an in-memory fixed window storage for high request
+// rates. Keys are hashed to a fixed number of mutex guarded shards holding
+// plain maps, avoiding the per-key allocations of MemoryStorage.
+//
+// It only supports the fixed window algorithm: limiters using any other
+// algorithm, rules or escalating blocks fail with
+// ratelimiter.ErrAlgorithmNotSupported.
+type ShardedMemoryStorage struct {
+	shards []shard
+	mask   uint64
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewShardedMemoryStorage creates a new sharded memory storage. Stale keys are
+// only removed in the background with WithShardedCleanupInterval, which starts
+// a janitor goroutine that runs until Close is called.
+func NewShardedMemoryStorage(opts ...ShardedOption) *ShardedMemoryStorage {
+	options := ShardedOptions{
+		Shards: 256, // Default: 256 shards
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	n := uint64(1)
+	if options.Shards > 1 {
+		n = 1 << bits.Len64(uint64(options.Shards-1))
+	}
+
+	s := &ShardedMemoryStorage{
+		shards: make([]shard, n),
+		mask:   n - 1,
+		stop:   make(chan struct{}),
+	}
+	for i := range s.shards {
+		s.shards[i].entries = make(map[string]shardedEntry, options.ShardCapacity)
+	}
+
+	if options.CleanupInterval > 0 {
+		go s.janitor(options.CleanupInterval)
+	}
+	return s
+}
+
+// Close stops the janitor. The storage remains usable.
+func (s *ShardedMemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// Len returns the number of keys stored
+func (s *ShardedMemoryStorage) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// shard returns the shard of a key, hashing it with FNV-1a
+func (s *ShardedMemoryStorage) shard(key string) *shard {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return &s.shards[h&s.mask]
+}
+
+// janitor removes stale keys every interval until the storage is closed
+func (s *ShardedMemoryStorage) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.cleanup(now)
+		}
+	}
+}
+
+// cleanup removes the keys whose state has gone stale by now, one shard at a time
+func (s *ShardedMemoryStorage) cleanup(now time.Time) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for key, e := range sh.entries {
+			if e.expires < now.UnixNano() {
+				delete(sh.entries, key)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// add counts n requests in the window containing now and returns the window's end.
+// A caller racing behind the latest window is counted in it rather than resetting it.
+func (e *shardedEntry) add(now time.Time, window time.Duration, n int) time.Time {
+	nowNs := now.UnixNano()
+	if e.start == 0 || nowNs-e.start >= int64(window) {
+		e.start, e.count = nowNs, 0
+	}
+
+	e.count += n
+
+	end := e.start + int64(window)
+	e.expires = max(e.expires, end)
+	return time.Unix(0, end)
+}
+
+// IncrementRequests increments the request count for a key by n
+func (s *ShardedMemoryStorage) IncrementRequests(_ context.Context, key string, now time.Time, window time.Duration, n int) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e := sh.entries[key]
+	e.add(now, window, n)
+	sh.entries[key] = e
+	return e.count, nil
+}
+
+// GetRequests returns the current request count for a key
+func (s *ShardedMemoryStorage) GetRequests(_ context.Context, key string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return sh.entries[key].count, nil
+}
+
+// IsBlocked checks if a key is blocked
+func (s *ShardedMemoryStorage) IsBlocked(_ context.Context, key string) (bool, time.Time, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if e, ok := sh.entries[key]; ok && time.Now().UnixNano() < e.block {
+		return true, time.Unix(0, e.block), nil
+	}
+	return false, time.Time{}, nil
+}
+
+// Block marks a key as blocked until the specified time
+func (s *ShardedMemoryStorage) Block(_ context.Context, key string, until time.Time) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e := sh.entries[key]
+	e.block = until.UnixNano()
+	e.expires = max(e.expires, e.block)
+	sh.entries[key] = e
+	return nil
+}
+
+// Reset resets all rate limit data for a key
+func (s *ShardedMemoryStorage) Reset(_ context.Context, key string) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	delete(sh.entries, key)
+	return nil
+}
+
+// AllowFixedWindow checks the block, counts a request of cost n and blocks the key once the count exceeds limit
+func (s *ShardedMemoryStorage) AllowFixedWindow(_ context.Context, key string, now time.Time, window time.Duration, limit int, blockDuration time.Duration, n int) (ratelimiter.Result, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e := sh.entries[key]
+
+	if now.UnixNano() < e.block {
+		until := time.Unix(0, e.block)
+		return ratelimiter.Result{
+			Allowed:    false,
+			RetryAfter: until,
+			Count:      limit,
+			ResetAt:    until,
+		}, nil
+	}
+
+	resetAt := e.add(now, window, n)
+	if e.count <= limit {
+		sh.entries[key] = e
+		return ratelimiter.Result{
+			Allowed:   true,
+			Remaining: max(limit-e.count, 0),
+			Count:     e.count,
+			ResetAt:   resetAt,
+		}, nil
+	}
+
+	// Without a block duration the key is limited until the window resets
+	until := resetAt
+	if blockDuration > 0 {
+		until = now.Add(blockDuration)
+		e.block = until.UnixNano()
+		e.expires = max(e.expires, e.block)
+	}
+	sh.entries[key] = e
+
+	return ratelimiter.Result{
+		Allowed:    false,
+		RetryAfter: until,
+		Count:      e.count,
+		ResetAt:    until,
+	}, nil
+}
+
+// RefundFixedWindow uncounts n requests counted at counted, unless the key's window has reset since
+func (s *ShardedMemoryStorage) RefundFixedWindow(_ context.Context, key string, now, counted time.Time, window time.Duration, n int) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.entries[key]
+	if !ok || counted.UnixNano() < e.start || now.UnixNano()-e.start >= int64(window) {
+		return nil
+	}
+	e.count = max(e.count-n, 0)
+	sh.entries[key] = e
+	return nil
+}
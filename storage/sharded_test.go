@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devfullcycle/ratelimiter/ratelimiter"
+)
+
+func TestShardedMemoryStorage(t *testing.T) {
+	storage := NewShardedMemoryStorage()
+	defer storage.Close()
+	ctx := context.Background()
+
+	// Test increment requests
+	count, err := storage.IncrementRequests(ctx, "test-ip", time.Now(), time.Minute, 1)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected count 1, got %d", count)
+	}
+
+	// Test block
+	blockUntil := time.Now().Add(time.Minute)
+	if err := storage.Block(ctx, "test-ip", blockUntil); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	blocked, retryAfter, err := storage.IsBlocked(ctx, "test-ip")
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if !blocked || !retryAfter.Equal(blockUntil) {
+		t.Errorf("Expected IP to be blocked until %v, got %v (blocked: %v)", blockUntil, retryAfter, blocked)
+	}
+
+	// Test reset
+	if err := storage.Reset(ctx, "test-ip"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "test-ip"); count != 0 {
+		t.Errorf("Expected count 0 after reset, got %d", count)
+	}
+	if blocked, _, _ := storage.IsBlocked(ctx, "test-ip"); blocked {
+		t.Error("Expected IP to be unblocked after reset")
+	}
+}
+
+func TestShardedMemoryStorageShards(t *testing.T) {
+	tests := []struct {
+		shards int
+		want   int
+	}{
+		{0, 1},
+		{1, 1},
+		{3, 4},
+		{64, 64},
+		{100, 128},
+	}
+
+	for _, tt := range tests {
+		storage := NewShardedMemoryStorage(WithShards(tt.shards))
+		storage.Close()
+		if len(storage.shards) != tt.want {
+			t.Errorf("Expected %d shards for %d, got %d", tt.want, tt.shards, len(storage.shards))
+		}
+	}
+}
+
+func TestShardedMemoryStorageLimiter(t *testing.T) {
+	storage := NewShardedMemoryStorage()
+	defer storage.Close()
+	limiter := ratelimiter.New(storage, ratelimiter.WithMaxRequests(2), ratelimiter.WithBlockDuration(time.Minute))
+
+	for i := 0; i < 2; i++ {
+		resp, err := limiter.Allow("test-ip")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !resp.Allowed || resp.RequestsLeft != 1-i {
+			t.Errorf("Expected request %d to be allowed with %d left, got %+v", i+1, 1-i, resp)
+		}
+	}
+
+	resp, err := limiter.Allow("test-ip")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Allowed {
+		t.Error("Expected request over the limit to be denied")
+	}
+	if wait := time.Until(resp.RetryAfter); wait <= 59*time.Second {
+		t.Errorf("Expected to be blocked for a minute, got %v", wait)
+	}
+
+	// Other algorithms, rules and escalation need the full memory storage
+	for _, opt := range []ratelimiter.Option{
+		ratelimiter.WithAlgorithm(ratelimiter.TokenBucket),
+		ratelimiter.WithRules(ratelimiter.Rule{Name: "minute", MaxRequests: 10, TimeWindow: time.Minute}),
+		ratelimiter.WithEscalation(ratelimiter.Escalation{Multiplier: 2, Decay: time.Hour}),
+	} {
+		limiter = ratelimiter.New(storage, opt)
+		if _, err := limiter.Allow("other-ip"); err != ratelimiter.ErrAlgorithmNotSupported {
+			t.Errorf("Expected ErrAlgorithmNotSupported, got %v", err)
+		}
+	}
+}
+
+func TestShardedMemoryStorageRefund(t *testing.T) {
+	storage := NewShardedMemoryStorage()
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	storage.IncrementRequests(ctx, "test-ip", now, time.Minute, 2)
+	if err := storage.RefundFixedWindow(ctx, "test-ip", now, now, time.Minute, 3); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "test-ip"); count != 0 {
+		t.Errorf("Expected refunds to stop at zero, got count %d", count)
+	}
+
+	// Requests counted in an earlier window aren't refunded from the current one
+	later := now.Add(2 * time.Minute)
+	storage.IncrementRequests(ctx, "test-ip", later, time.Minute, 1)
+	if err := storage.RefundFixedWindow(ctx, "test-ip", later, now, time.Minute, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, _ := storage.GetRequests(ctx, "test-ip"); count != 1 {
+		t.Errorf("Expected refund from an earlier window to be skipped, got count %d", count)
+	}
+}
+
+func TestShardedMemoryStorageConcurrency(t *testing.T) {
+	const goroutines, requests = 32, 80
+
+	storage := NewShardedMemoryStorage(WithShards(4))
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				storage.IncrementRequests(ctx, fmt.Sprintf("key-%d", i%8), now, time.Minute, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		if count, _ := storage.GetRequests(ctx, fmt.Sprintf("key-%d", i)); count != goroutines*requests/8 {
+			t.Errorf("Expected %d requests for key-%d, got %d", goroutines*requests/8, i, count)
+		}
+	}
+}
+
+func TestShardedMemoryStorageCleanup(t *testing.T) {
+	storage := NewShardedMemoryStorage()
+	defer storage.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	storage.IncrementRequests(ctx, "expired", now, time.Second, 1)
+	storage.IncrementRequests(ctx, "active", now, time.Hour, 1)
+	storage.Block(ctx, "blocked", now.Add(time.Hour))
+
+	storage.cleanup(now.Add(time.Minute))
+
+	if n := storage.Len(); n != 2 {
+		t.Errorf("Expected 2 keys after cleanup, got %d", n)
+	}
+	if count, _ := storage.GetRequests(ctx, "expired"); count != 0 {
+		t.Errorf("Expected expired key to be removed, got count %d", count)
+	}
+	if blocked, _, _ := storage.IsBlocked(ctx, "blocked"); !blocked {
+		t.Error("Expected block to be kept until it expires")
+	}
+}
+
+func TestShardedMemoryStorageJanitor(t *testing.T) {
+	storage := NewShardedMemoryStorage(WithShardedCleanupInterval(10 * time.Millisecond))
+	defer storage.Close()
+	ctx := context.Background()
+
+	storage.IncrementRequests(ctx, "expiring", time.Now(), 20*time.Millisecond, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := storage.Len(); n != 0 {
+		t.Errorf("Expected the janitor to remove the stale key, got %d keys", n)
+	}
+
+	// Without a janitor, the default, stale keys stay
+	storage = NewShardedMemoryStorage()
+	storage.IncrementRequests(ctx, "expiring", time.Now(), 20*time.Millisecond, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := storage.Len(); n != 1 {
+		t.Errorf("Expected the stale key to stay without a janitor, got %d keys", n)
+	}
+}
+
+// benchmarkFixedWindow runs fixed window checks from parallel goroutines
+// spread over the given number of keys
+func benchmarkFixedWindow(b *testing.B, storage ratelimiter.FixedWindowStorage, keys int) {
+	ctx := context.Background()
+	now := time.Now()
+
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("192.0.2.%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			storage.AllowFixedWindow(ctx, names[i%keys], now, time.Hour, 1<<30, 0, 1)
+			i++
+		}
+	})
+}
+
+func BenchmarkFixedWindow(b *testing.B) {
+	for _, keys := range []int{1, 1024, 65536} {
+		b.Run(fmt.Sprintf("memory/keys=%d", keys), func(b *testing.B) {
+			storage := NewMemoryStorage()
+			defer storage.Close()
+			benchmarkFixedWindow(b, storage, keys)
+		})
+		b.Run(fmt.Sprintf("sharded/keys=%d", keys), func(b *testing.B) {
+			storage := NewShardedMemoryStorage()
+			defer storage.Close()
+			benchmarkFixedWindow(b, storage, keys)
+		})
+	}
+}